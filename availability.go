@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const DEFAULT_POLL_INTERVAL = 15 * time.Second
+
+// Accounts the time since the service was last observed to the state it was
+// observed in then, and records that it's now up or down.  If the service has
+// come up since, the time after its process started (at started, which is
+// only used if up is set) is accounted as up instead.  The time before the
+// first observation, including any time the exporter wasn't running, is not
+// accounted at all.
+func (svc *service) observeAvailability(now time.Time, up bool, started time.Time) {
+	last := svc.lastObservedTime
+	if !last.IsZero() && now.After(last) {
+		boundary := now
+		if up && !svc.lastObservedUp {
+			if started.After(last) && started.Before(now) {
+				boundary = started
+			}
+		}
+		if svc.lastObservedUp {
+			svc.upSeconds += boundary.Sub(last).Seconds()
+		} else {
+			svc.downSeconds += boundary.Sub(last).Seconds()
+		}
+		if up {
+			svc.upSeconds += now.Sub(boundary).Seconds()
+		} else {
+			svc.downSeconds += now.Sub(boundary).Seconds()
+		}
+	}
+	svc.lastObservedTime = now
+	svc.lastObservedUp = up
+}
+
+// Scrapes all services every interval, so that transitions are noticed even if
+// the exporter is scraped rarely, and saves the state, including the time
+// accounted as up or down.  Probes are left to the actual scrapes.  A check
+// is given at most interval to finish, and while it runs, scrapes wait for it
+// only as long as their own timeout allows (see collect).  Never returns.
+func (c *SvcCollector) poll(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		c.mu.Lock()
+		c.scrapeServices(ctx, c.services)
+		c.saveState(true)
+		c.mu.Unlock()
+		cancel()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Auxiliary vector entry types, from <elf.h>.
+const (
+	AT_NULL   uint64 = 0
+	AT_CLKTCK uint64 = 17
+)
+
+// Sources for the clock tick rate, as reported in
+// service_exporter_clock_ticks_info.
+const (
+	CLK_TCK_SOURCE_FLAG    = "flag"
+	CLK_TCK_SOURCE_AUXV    = "auxv"
+	CLK_TCK_SOURCE_GETCONF = "getconf"
+)
+
+var errAuxvNoClockTicks = errors.New("AT_CLKTCK not present in auxiliary vector")
+
+// Parses the contents of /proc/self/auxv, which is a list of (type, value)
+// pairs of native machine words, and returns the value of AT_CLKTCK.
+func parseAuxvClockTicks(auxv []byte) (int, error) {
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	readWord := func(b []byte) uint64 {
+		if wordSize == 8 {
+			return binary.NativeEndian.Uint64(b)
+		}
+		return uint64(binary.NativeEndian.Uint32(b))
+	}
+	for i := 0; i+2*wordSize <= len(auxv); i += 2 * wordSize {
+		typ := readWord(auxv[i:])
+		val := readWord(auxv[i+wordSize:])
+		if typ == AT_NULL {
+			break
+		}
+		if typ == AT_CLKTCK {
+			if val == 0 {
+				return 0, fmt.Errorf("invalid AT_CLKTCK value %d", val)
+			}
+			return int(val), nil
+		}
+	}
+	return 0, errAuxvNoClockTicks
+}
+
+func readAuxvClockTicks() (int, error) {
+	auxv, err := ioutil.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return 0, err
+	}
+	return parseAuxvClockTicks(auxv)
+}
+
+func getconfClockTicks() (int, error) {
+	cmd := exec.Command("getconf", "CLK_TCK")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		errStr := err.Error()
+		if len(output) > 0 {
+			errStr = (strings.SplitN(string(output), "\n", 2))[0]
+		}
+		return 0, fmt.Errorf("command 'getconf CLK_TCK' failed: %s", errStr)
+	}
+	clockTicks, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected output from 'getconf CLK_TCK': %s", err)
+	}
+	if clockTicks <= 0 {
+		return 0, fmt.Errorf("unexpected output from 'getconf CLK_TCK': %d", clockTicks)
+	}
+	return clockTicks, nil
+}
+
+// Determines the clock tick rate (sysconf(_SC_CLK_TCK)) of the system.  If
+// override is positive, it is used as is.  Otherwise the value is read from
+// the auxiliary vector of the current process, falling back to running
+// getconf.  Also returns the source the value was determined from.
+func determineClockTicks(override int) (clockTicks int, source string, err error) {
+	if override > 0 {
+		return override, CLK_TCK_SOURCE_FLAG, nil
+	}
+	clockTicks, err = readAuxvClockTicks()
+	if err == nil {
+		return clockTicks, CLK_TCK_SOURCE_AUXV, nil
+	}
+	slog.Warn("could not read CLK_TCK from the auxiliary vector, falling back to getconf", "err", err)
+	clockTicks, err = getconfClockTicks()
+	if err != nil {
+		return 0, "", err
+	}
+	return clockTicks, CLK_TCK_SOURCE_GETCONF, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+// Builds an auxiliary vector from (type, value) pairs in native machine words.
+func makeAuxv(pairs ...uint64) []byte {
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+	auxv := make([]byte, len(pairs) * wordSize)
+	for i, word := range pairs {
+		if wordSize == 8 {
+			binary.NativeEndian.PutUint64(auxv[i * wordSize:], word)
+		} else {
+			binary.NativeEndian.PutUint32(auxv[i * wordSize:], uint32(word))
+		}
+	}
+	return auxv
+}
+
+func TestParseAuxvClockTicks(t *testing.T) {
+	const AT_PAGESZ, AT_HWCAP = 6, 16
+	withClockTicks := makeAuxv(AT_HWCAP, 0xbfebfbff, AT_PAGESZ, 4096, AT_CLKTCK, 100, AT_NULL, 0)
+	wordSize := int(unsafe.Sizeof(uintptr(0)))
+
+	tests := []struct {
+		name string
+		auxv []byte
+		clockTicks int
+		// Empty if parsing should succeed
+		err string
+	}{
+		{
+			name: "AT_CLKTCK present",
+			auxv: withClockTicks,
+			clockTicks: 100,
+		},
+		{
+			name: "AT_CLKTCK first",
+			auxv: makeAuxv(AT_CLKTCK, 250, AT_NULL, 0),
+			clockTicks: 250,
+		},
+		{
+			name: "no terminating AT_NULL",
+			auxv: makeAuxv(AT_PAGESZ, 4096, AT_CLKTCK, 1000),
+			clockTicks: 1000,
+		},
+		{
+			name: "AT_CLKTCK missing",
+			auxv: makeAuxv(AT_HWCAP, 0xbfebfbff, AT_PAGESZ, 4096, AT_NULL, 0),
+			err: errAuxvNoClockTicks.Error(),
+		},
+		{
+			name: "AT_CLKTCK after AT_NULL",
+			auxv: makeAuxv(AT_PAGESZ, 4096, AT_NULL, 0, AT_CLKTCK, 100),
+			err: errAuxvNoClockTicks.Error(),
+		},
+		{
+			name: "AT_CLKTCK zero",
+			auxv: makeAuxv(AT_CLKTCK, 0, AT_NULL, 0),
+			err: "invalid AT_CLKTCK value 0",
+		},
+		{
+			name: "truncated within the AT_CLKTCK value",
+			auxv: withClockTicks[:5 * wordSize + wordSize / 2],
+			err: errAuxvNoClockTicks.Error(),
+		},
+		{
+			name: "truncated within the AT_CLKTCK type",
+			auxv: withClockTicks[:4 * wordSize + 3],
+			err: errAuxvNoClockTicks.Error(),
+		},
+		{
+			name: "empty",
+			auxv: nil,
+			err: errAuxvNoClockTicks.Error(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clockTicks, err := parseAuxvClockTicks(test.auxv)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got %d, error %v, expected error %q", clockTicks, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clockTicks != test.clockTicks {
+				t.Errorf("got %d, expected %d", clockTicks, test.clockTicks)
+			}
+		})
+	}
+}
+
+func TestReadAuxvClockTicks(t *testing.T) {
+	clockTicks, err := readAuxvClockTicks()
+	if err != nil {
+		t.Skipf("could not read the auxiliary vector: %s", err)
+	}
+	if clockTicks <= 0 {
+		t.Errorf("got clock tick rate %d", clockTicks)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Runs command, with env added to the environment of the exporter, and returns
+// an error, including the first line of the command's output if any, unless it
+// exits with status 0.  The command is killed if ctx expires, which is taken
+// to mean that it timed out after timeout.
+func runCommand(ctx context.Context, command []string, env []string, timeout time.Duration) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// Don't wait for any grandchildren still holding on to the output pipe
+	// once the command has been killed; for probes, the deadline can be
+	// Prometheus's.
+	cmd.WaitDelay = 100 * time.Millisecond
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return fmt.Errorf("command timed out after %s", timeout)
+	}
+	if err != nil {
+		if len(output) > 0 {
+			return fmt.Errorf("%s: %s", err, (strings.SplitN(string(output), "\n", 2))[0])
+		}
+		return err
+	}
+	return nil
+}
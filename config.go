@@ -0,0 +1,775 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The contents of the file given with --config.  Services listed on the
+// command line are added to the ones listed in the file with the default
+// configuration.
+type config struct {
+	Services []*serviceConfig `yaml:"services"`
+
+	// If set, services are additionally discovered from the init system.
+	Discovery *discoveryConfig `yaml:"discovery"`
+
+	// How services are classified as stable, flapping or crashlooping,
+	// unless overridden per service
+	Stability *stabilityConfig `yaml:"stability"`
+
+	// If set, the /probe endpoint is enabled for the services it allows.
+	ProbeEndpoint *probeEndpointConfig `yaml:"probe_endpoint"`
+
+	// Notified when a service goes down, comes up or restarts; see hooks.go
+	Hooks []*hookConfig `yaml:"hooks"`
+
+	// The directory containing the runit services.  Defaults to
+	// DEFAULT_RUNIT_SERVICE_DIR.
+	RunitServiceDir string `yaml:"runit_service_dir"`
+
+	// The backend given on the command line
+	defaultBackend string
+
+	// The services whose names are patterns; removed from Services
+	patterns []*serviceConfig
+}
+
+type discoveryConfig struct {
+	// The init system to discover services from.  Defaults to the backend
+	// given on the command line.
+	Backend string `yaml:"backend"`
+
+	// How often to look for new or removed services.  Also used for
+	// services whose names are patterns.
+	Interval time.Duration `yaml:"interval"`
+
+	// A discovered service is monitored if its name (or for instances,
+	// "job (instance)" for Upstart and "template@instance" for systemd)
+	// matches any of the glob patterns in Include or the regular expressions
+	// in IncludeRegex, and none of the ones in Exclude and ExcludeRegex.  If
+	// neither Include nor IncludeRegex is set, all services are included.
+	Include []string `yaml:"include"`
+	IncludeRegex []string `yaml:"include_regex"`
+	Exclude []string `yaml:"exclude"`
+	ExcludeRegex []string `yaml:"exclude_regex"`
+
+	includeRegexps []*regexp.Regexp
+	excludeRegexps []*regexp.Regexp
+}
+
+type stabilityConfig struct {
+	// A service is crashlooping if it restarted at least CrashloopRestarts
+	// times within CrashloopWindow, or otherwise flapping if it restarted at
+	// least FlappingRestarts times within FlappingWindow.  Defaults to 5
+	// restarts in 10m and 3 restarts in 1h.  A service's restarts are no
+	// longer counted as consecutive once it has stayed up for CrashloopWindow.
+	CrashloopRestarts int `yaml:"crashloop_restarts"`
+	CrashloopWindow time.Duration `yaml:"crashloop_window"`
+	FlappingRestarts int `yaml:"flapping_restarts"`
+	FlappingWindow time.Duration `yaml:"flapping_window"`
+}
+
+// Hook types
+const (
+	HOOK_TYPE_WEBHOOK = "webhook"
+	HOOK_TYPE_COMMAND = "command"
+)
+
+const (
+	DEFAULT_HOOK_TIMEOUT = 10 * time.Second
+	DEFAULT_HOOK_RETRIES = 3
+	DEFAULT_HOOK_RATE_LIMIT = 10
+	DEFAULT_HOOK_RATE_LIMIT_INTERVAL = time.Minute
+)
+
+type hookConfig struct {
+	// Identifies the hook in the log and in
+	// service_exporter_hook_notifications_total.  Defaults to the type and
+	// the position of the hook in the list, e.g. "webhook1".
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// The events to notify of, out of "down", "up" and "restart".  Defaults
+	// to all of them.
+	Events []string `yaml:"events"`
+
+	// For webhooks, the URL to POST the event to as JSON, and any headers to
+	// add to the request
+	URL string `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+
+	// For command hooks, the command and its arguments.  The event is passed
+	// in SERVICE_EXPORTER_* environment variables.
+	Command []string `yaml:"command"`
+
+	// How long a single attempt to notify may take, and how many times a
+	// failed attempt is retried, with exponential backoff
+	Timeout time.Duration `yaml:"timeout"`
+	Retries *int `yaml:"retries"`
+
+	// At most RateLimit events are notified within any RateLimitInterval;
+	// further events are dropped
+	RateLimit int `yaml:"rate_limit"`
+	RateLimitInterval time.Duration `yaml:"rate_limit_interval"`
+
+	events map[string]bool
+	retries int
+}
+
+type probeEndpointConfig struct {
+	// The services which can be probed through /probe, identified like in
+	// discoveryConfig.  Only services matching one of the glob patterns in
+	// Allow or the regular expressions in AllowRegex can be probed.
+	Allow []string `yaml:"allow"`
+	AllowRegex []string `yaml:"allow_regex"`
+
+	allowRegexps []*regexp.Regexp
+}
+
+type serviceConfig struct {
+	Name string `yaml:"name"`
+
+	// The init system managing the service; one of the BACKEND_* constants.
+	// Defaults to the backend given on the command line.
+	Backend string `yaml:"backend"`
+
+	// For multi-instance Upstart jobs, the instance to monitor, e.g. "tty1"
+	// for the job "tty".  For systemd, the instance of the template unit, e.g.
+	// "1" for "worker@1".
+	//
+	// Alternatively, for systemd the name can be a glob pattern such as
+	// "worker@*.service", in which case all matching units are monitored with
+	// the settings given here.
+	Instance string `yaml:"instance"`
+
+	// How long to wait for the init system to answer when scraping the
+	// service, after which the last known state is reported.  Defaults to
+	// DEFAULT_SCRAPE_TIMEOUT.  Scrapes by Prometheus are additionally limited
+	// by its scrape timeout.
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+
+	// If set, CPU time and context switches are additionally broken down by
+	// thread name.
+	Threads *threadsConfig `yaml:"threads"`
+
+	// If set, the scheduler statistics are summed over all threads of the
+	// process instead of only covering the main thread.
+	SchedstatAllThreads bool `yaml:"schedstat_all_threads"`
+
+	// If set, the sockets the service is listening on are exported.
+	Listening *listeningConfig `yaml:"listening"`
+
+	// If set, the service's TCP connections are counted by state.
+	TCPConnections *tcpConnectionsConfig `yaml:"tcp_connections"`
+
+	// If set, the health of the service is actively probed on each scrape.
+	Probe *probeConfig `yaml:"probe"`
+
+	// If set, the service is a oneshot or periodic job, and its past and
+	// future runs are exported.
+	Job *jobConfig `yaml:"job"`
+
+	// Overrides the global stability settings
+	Stability *stabilityConfig `yaml:"stability"`
+
+	// Copied from the global configuration
+	runitServiceDir string
+
+	// Whether the service was discovered rather than listed in the
+	// configuration or on the command line; also set for services probed
+	// through /probe without being listed
+	discovered bool
+}
+
+// Probe types
+const (
+	PROBE_TYPE_TCP = "tcp"
+	PROBE_TYPE_HTTP = "http"
+	PROBE_TYPE_UNIX = "unix"
+	PROBE_TYPE_COMMAND = "command"
+)
+
+const DEFAULT_PROBE_TIMEOUT = 5 * time.Second
+
+type probeConfig struct {
+	Type string `yaml:"type"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// For tcp probes, the host:port to connect to
+	Address string `yaml:"address"`
+
+	// For http probes, the URL to GET.  Unless ExpectedStatus is set, any 2xx
+	// status is considered a success.  If BodyRegex is set, the response body
+	// must match it.
+	URL string `yaml:"url"`
+	ExpectedStatus int `yaml:"expected_status"`
+	BodyRegex string `yaml:"body_regex"`
+
+	// For unix probes, the path of the socket to connect to
+	Path string `yaml:"path"`
+
+	// For command probes, the command and its arguments.  The probe succeeds
+	// if the command exits with status 0 within the timeout.
+	Command []string `yaml:"command"`
+
+	bodyRegexp *regexp.Regexp
+}
+
+type jobConfig struct {
+	// For systemd, the timer unit triggering the job.  Defaults to the name of
+	// the service's unit with a ".timer" suffix.
+	Timer string `yaml:"timer"`
+}
+
+func (jc *jobConfig) timerUnit(svcCfg *serviceConfig) string {
+	if jc.Timer != "" {
+		return jc.Timer
+	}
+	return strings.TrimSuffix(svcCfg.systemdUnit(), ".service") + ".timer"
+}
+
+type listeningConfig struct {
+	ExpectedPorts []*expectedPortConfig `yaml:"expected_ports"`
+}
+
+type tcpConnectionsConfig struct {
+	// If set, the accept queue length of each listening TCP socket is also
+	// exported.
+	AcceptQueue bool `yaml:"accept_queue"`
+}
+
+type expectedPortConfig struct {
+	// "tcp" or "udp"; matches both IPv4 and IPv6 sockets.  Defaults to "tcp".
+	Proto string `yaml:"proto"`
+	Port int `yaml:"port"`
+}
+
+type threadsConfig struct {
+	// The maximum number of distinct (normalized) thread names exported per
+	// service.  Any threads beyond the limit are aggregated under the name
+	// THREAD_NAME_OTHER.
+	MaxThreads int `yaml:"max_threads"`
+
+	// Thread names are normalized by replacing all matches of NormalizeRegex
+	// with NormalizeReplacement, e.g. to collapse "pool-1-thread-17" and
+	// "pool-1-thread-18" into a single name.
+	NormalizeRegex string `yaml:"normalize_regex"`
+	NormalizeReplacement string `yaml:"normalize_replacement"`
+
+	normalizeRegexp *regexp.Regexp
+}
+
+// Backends
+const (
+	BACKEND_UPSTART = "upstart"
+	BACKEND_SYSTEMD = "systemd"
+	BACKEND_RUNIT = "runit"
+)
+
+const DEFAULT_RUNIT_SERVICE_DIR = "/etc/service"
+
+const DEFAULT_DISCOVERY_INTERVAL = 5 * time.Minute
+
+const DEFAULT_SCRAPE_TIMEOUT = 10 * time.Second
+
+const (
+	DEFAULT_CRASHLOOP_RESTARTS = 5
+	DEFAULT_CRASHLOOP_WINDOW = 10 * time.Minute
+	DEFAULT_FLAPPING_RESTARTS = 3
+	DEFAULT_FLAPPING_WINDOW = time.Hour
+)
+
+const (
+	DEFAULT_MAX_THREADS = 50
+	DEFAULT_THREAD_NORMALIZE_REGEX = "[0-9]+"
+	DEFAULT_THREAD_NORMALIZE_REPLACEMENT = "N"
+)
+
+func readConfigFile(filename string) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &config{}
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	return cfg, nil
+}
+
+// Adds the services named on the command line to the configuration, and
+// validates the configuration and fills in default values.
+func (cfg *config) finalize(serviceNames []string, defaultBackend string) error {
+	cfg.defaultBackend = defaultBackend
+	if !isValidBackend(defaultBackend) {
+		return fmt.Errorf("invalid backend %q", defaultBackend)
+	}
+	if cfg.RunitServiceDir == "" {
+		cfg.RunitServiceDir = DEFAULT_RUNIT_SERVICE_DIR
+	}
+	if cfg.Discovery != nil {
+		err := cfg.Discovery.finalize(defaultBackend)
+		if err != nil {
+			return fmt.Errorf("discovery: %s", err)
+		}
+	}
+
+	if cfg.Stability == nil {
+		cfg.Stability = &stabilityConfig{}
+	}
+	err := cfg.Stability.finalize()
+	if err != nil {
+		return fmt.Errorf("stability: %s", err)
+	}
+	if cfg.ProbeEndpoint != nil {
+		err := cfg.ProbeEndpoint.finalize()
+		if err != nil {
+			return fmt.Errorf("probe_endpoint: %s", err)
+		}
+	}
+	hookNames := make(map[string]bool)
+	for i, hc := range cfg.Hooks {
+		if hc.Name == "" {
+			hc.Name = fmt.Sprintf("%s%d", hc.Type, i + 1)
+		}
+		err := hc.finalize()
+		if err != nil {
+			return fmt.Errorf("hook %s: %s", hc.Name, err)
+		}
+		if hookNames[hc.Name] {
+			return fmt.Errorf("hook %s listed more than once", hc.Name)
+		}
+		hookNames[hc.Name] = true
+	}
+
+	for _, name := range serviceNames {
+		cfg.Services = append(cfg.Services, &serviceConfig{Name: name})
+	}
+
+	seen := make(map[string]bool)
+	var services []*serviceConfig
+	for _, svcCfg := range cfg.Services {
+		if svcCfg.Name == "" {
+			return fmt.Errorf("service without a name")
+		}
+		err := svcCfg.finalize(cfg)
+		if err != nil {
+			return fmt.Errorf("service %s: %s", svcCfg.Name, err)
+		}
+		if seen[svcCfg.key()] {
+			return fmt.Errorf("service %s listed more than once", svcCfg.key())
+		}
+		seen[svcCfg.key()] = true
+
+		if svcCfg.isPattern() {
+			cfg.patterns = append(cfg.patterns, svcCfg)
+		} else {
+			services = append(services, svcCfg)
+		}
+	}
+	cfg.Services = services
+	return nil
+}
+
+// Whether the name of the service is a glob pattern matching any number of
+// systemd units, such as "worker@*.service".
+func (svcCfg *serviceConfig) isPattern() bool {
+	return strings.ContainsAny(svcCfg.Name, "*?[")
+}
+
+// For patterns, whether the given systemd unit matches.
+func (svcCfg *serviceConfig) matchesUnit(unit string) bool {
+	pattern := svcCfg.Name
+	if !strings.HasSuffix(pattern, ".service") {
+		pattern += ".service"
+	}
+	matched, _ := path.Match(pattern, unit)
+	return matched
+}
+
+// Returns the configuration of a systemd unit matching a pattern.  The
+// settings are inherited from the pattern.
+func (svcCfg *serviceConfig) newPatternInstanceConfig(name string,
+	instance string) *serviceConfig {
+	instanceCfg := *svcCfg
+	instanceCfg.Name = name
+	instanceCfg.Instance = instance
+	instanceCfg.discovered = true
+	return &instanceCfg
+}
+
+// Uniquely identifies the service, in the format used by the init system,
+// e.g. "tty (tty1)" for Upstart or "worker@1" for systemd.
+func (svcCfg *serviceConfig) key() string {
+	if svcCfg.Instance == "" {
+		return svcCfg.Name
+	}
+	if svcCfg.Backend == BACKEND_SYSTEMD {
+		return svcCfg.systemdUnit()
+	}
+	return svcCfg.Name + " (" + svcCfg.Instance + ")"
+}
+
+// The name of the systemd unit of the service.  For instances of template
+// units, the name is the name of the template, e.g. "worker" for
+// "worker@1".
+func (svcCfg *serviceConfig) systemdUnit() string {
+	if svcCfg.Instance == "" {
+		return svcCfg.Name
+	}
+	return svcCfg.Name + "@" + svcCfg.Instance
+}
+
+// Whether services need to be discovered, either because discovery is
+// enabled or because some service names are patterns.
+func (cfg *config) needsDiscovery() bool {
+	return cfg.Discovery != nil || len(cfg.patterns) > 0
+}
+
+func (cfg *config) discoveryInterval() time.Duration {
+	if cfg.Discovery != nil {
+		return cfg.Discovery.Interval
+	}
+	return DEFAULT_DISCOVERY_INTERVAL
+}
+
+func isValidBackend(backend string) bool {
+	return backend == BACKEND_UPSTART || backend == BACKEND_SYSTEMD || backend == BACKEND_RUNIT
+}
+
+// Returns the configuration for a discovered service, using the default
+// settings.
+func (cfg *config) newDiscoveredServiceConfig(name string, instance string,
+	backend string) *serviceConfig {
+	svcCfg := &serviceConfig{
+		Name: name,
+		Backend: backend,
+		Instance: instance,
+		discovered: true,
+	}
+	err := svcCfg.finalize(cfg)
+	if err != nil {
+		// can't happen with the default settings
+		panic(err)
+	}
+	return svcCfg
+}
+
+func (dc *discoveryConfig) finalize(defaultBackend string) error {
+	if dc.Backend == "" {
+		dc.Backend = defaultBackend
+	}
+	if !isValidBackend(dc.Backend) {
+		return fmt.Errorf("invalid backend %q", dc.Backend)
+	}
+	if dc.Interval == 0 {
+		dc.Interval = DEFAULT_DISCOVERY_INTERVAL
+	} else if dc.Interval < 0 {
+		return fmt.Errorf("invalid interval %s", dc.Interval)
+	}
+	err := checkGlobs(append(append([]string{}, dc.Include...), dc.Exclude...))
+	if err != nil {
+		return err
+	}
+	dc.includeRegexps, err = compileRegexps(dc.IncludeRegex)
+	if err != nil {
+		return err
+	}
+	dc.excludeRegexps, err = compileRegexps(dc.ExcludeRegex)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Whether a discovered service should be monitored according to the include
+// and exclude filters.
+func (dc *discoveryConfig) matches(key string) bool {
+	included := len(dc.Include) == 0 && len(dc.includeRegexps) == 0 ||
+		matchesAny(key, dc.Include, dc.includeRegexps)
+	return included && !matchesAny(key, dc.Exclude, dc.excludeRegexps)
+}
+
+func (pc *probeEndpointConfig) finalize() error {
+	if len(pc.Allow) == 0 && len(pc.AllowRegex) == 0 {
+		return fmt.Errorf("allow or allow_regex is required")
+	}
+	err := checkGlobs(pc.Allow)
+	if err != nil {
+		return err
+	}
+	pc.allowRegexps, err = compileRegexps(pc.AllowRegex)
+	return err
+}
+
+// Whether the service identified by key can be probed through /probe.
+func (pc *probeEndpointConfig) allows(key string) bool {
+	return matchesAny(key, pc.Allow, pc.allowRegexps)
+}
+
+func checkGlobs(globs []string) error {
+	for _, glob := range globs {
+		_, err := path.Match(glob, "")
+		if err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %s", glob, err)
+		}
+	}
+	return nil
+}
+
+// Compiles regular expressions which have to match the whole string.
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", expr, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// Whether key matches any of the glob patterns or regular expressions.
+func matchesAny(key string, globs []string, regexps []*regexp.Regexp) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, key); matched {
+			return true
+		}
+	}
+	for _, re := range regexps {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (svcCfg *serviceConfig) finalize(cfg *config) error {
+	if svcCfg.Backend == "" {
+		svcCfg.Backend = cfg.defaultBackend
+	}
+	if !isValidBackend(svcCfg.Backend) {
+		return fmt.Errorf("invalid backend %q", svcCfg.Backend)
+	}
+	svcCfg.runitServiceDir = cfg.RunitServiceDir
+	if svcCfg.ScrapeTimeout == 0 {
+		svcCfg.ScrapeTimeout = DEFAULT_SCRAPE_TIMEOUT
+	} else if svcCfg.ScrapeTimeout < 0 {
+		return fmt.Errorf("invalid scrape_timeout %s", svcCfg.ScrapeTimeout)
+	}
+	if svcCfg.Instance != "" && svcCfg.Backend == BACKEND_RUNIT {
+		return fmt.Errorf("instance is not supported for runit services")
+	}
+	if svcCfg.isPattern() {
+		if svcCfg.Backend != BACKEND_SYSTEMD {
+			return fmt.Errorf("patterns are only supported for systemd services")
+		}
+		if svcCfg.Instance != "" {
+			return fmt.Errorf("instance can not be combined with a pattern")
+		}
+		_, err := path.Match(svcCfg.Name, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %s", err)
+		}
+	}
+	if svcCfg.Threads != nil {
+		err := svcCfg.Threads.finalize()
+		if err != nil {
+			return fmt.Errorf("threads: %s", err)
+		}
+	}
+	if svcCfg.Listening != nil {
+		err := svcCfg.Listening.finalize()
+		if err != nil {
+			return fmt.Errorf("listening: %s", err)
+		}
+	}
+	if svcCfg.Job != nil && svcCfg.Job.Timer != "" && svcCfg.Backend != BACKEND_SYSTEMD {
+		return fmt.Errorf("job: timer is only supported for systemd services")
+	}
+	if svcCfg.Probe != nil {
+		err := svcCfg.Probe.finalize()
+		if err != nil {
+			return fmt.Errorf("probe: %s", err)
+		}
+	}
+	if svcCfg.Stability == nil {
+		svcCfg.Stability = cfg.Stability
+	} else if svcCfg.Stability != cfg.Stability {
+		// Settings not overridden are inherited from the global ones
+		sc := svcCfg.Stability
+		if sc.CrashloopRestarts == 0 {
+			sc.CrashloopRestarts = cfg.Stability.CrashloopRestarts
+		}
+		if sc.CrashloopWindow == 0 {
+			sc.CrashloopWindow = cfg.Stability.CrashloopWindow
+		}
+		if sc.FlappingRestarts == 0 {
+			sc.FlappingRestarts = cfg.Stability.FlappingRestarts
+		}
+		if sc.FlappingWindow == 0 {
+			sc.FlappingWindow = cfg.Stability.FlappingWindow
+		}
+		err := sc.finalize()
+		if err != nil {
+			return fmt.Errorf("stability: %s", err)
+		}
+	}
+	return nil
+}
+
+func (hc *hookConfig) finalize() error {
+	switch hc.Type {
+	case HOOK_TYPE_WEBHOOK:
+		u, err := url.Parse(hc.URL)
+		if hc.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("an http or https url is required for webhooks")
+		}
+	case HOOK_TYPE_COMMAND:
+		if len(hc.Command) == 0 {
+			return fmt.Errorf("command is required for command hooks")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", hc.Type)
+	}
+	if len(hc.Events) == 0 {
+		hc.Events = serviceEvents
+	}
+	hc.events = make(map[string]bool)
+	for _, event := range hc.Events {
+		if !isValidServiceEvent(event) {
+			return fmt.Errorf("invalid event %q", event)
+		}
+		hc.events[event] = true
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = DEFAULT_HOOK_TIMEOUT
+	} else if hc.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s", hc.Timeout)
+	}
+	if hc.Retries == nil {
+		hc.retries = DEFAULT_HOOK_RETRIES
+	} else if *hc.Retries < 0 {
+		return fmt.Errorf("invalid retries %d", *hc.Retries)
+	} else {
+		hc.retries = *hc.Retries
+	}
+	if hc.RateLimit == 0 {
+		hc.RateLimit = DEFAULT_HOOK_RATE_LIMIT
+	} else if hc.RateLimit < 0 {
+		return fmt.Errorf("invalid rate_limit %d", hc.RateLimit)
+	}
+	if hc.RateLimitInterval == 0 {
+		hc.RateLimitInterval = DEFAULT_HOOK_RATE_LIMIT_INTERVAL
+	} else if hc.RateLimitInterval < 0 {
+		return fmt.Errorf("invalid rate_limit_interval %s", hc.RateLimitInterval)
+	}
+	return nil
+}
+
+func (sc *stabilityConfig) finalize() error {
+	if sc.CrashloopRestarts == 0 {
+		sc.CrashloopRestarts = DEFAULT_CRASHLOOP_RESTARTS
+	} else if sc.CrashloopRestarts < 0 {
+		return fmt.Errorf("invalid crashloop_restarts %d", sc.CrashloopRestarts)
+	}
+	if sc.CrashloopWindow == 0 {
+		sc.CrashloopWindow = DEFAULT_CRASHLOOP_WINDOW
+	} else if sc.CrashloopWindow < 0 {
+		return fmt.Errorf("invalid crashloop_window %s", sc.CrashloopWindow)
+	}
+	if sc.FlappingRestarts == 0 {
+		sc.FlappingRestarts = DEFAULT_FLAPPING_RESTARTS
+	} else if sc.FlappingRestarts < 0 {
+		return fmt.Errorf("invalid flapping_restarts %d", sc.FlappingRestarts)
+	}
+	if sc.FlappingWindow == 0 {
+		sc.FlappingWindow = DEFAULT_FLAPPING_WINDOW
+	} else if sc.FlappingWindow < 0 {
+		return fmt.Errorf("invalid flapping_window %s", sc.FlappingWindow)
+	}
+	return nil
+}
+
+func (pc *probeConfig) finalize() error {
+	if pc.Timeout == 0 {
+		pc.Timeout = DEFAULT_PROBE_TIMEOUT
+	} else if pc.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s", pc.Timeout)
+	}
+	switch pc.Type {
+	case PROBE_TYPE_TCP:
+		if pc.Address == "" {
+			return fmt.Errorf("address is required for tcp probes")
+		}
+	case PROBE_TYPE_HTTP:
+		if pc.URL == "" {
+			return fmt.Errorf("url is required for http probes")
+		}
+		if pc.BodyRegex != "" {
+			var err error
+			pc.bodyRegexp, err = regexp.Compile(pc.BodyRegex)
+			if err != nil {
+				return fmt.Errorf("invalid body_regex: %s", err)
+			}
+		}
+	case PROBE_TYPE_UNIX:
+		if pc.Path == "" {
+			return fmt.Errorf("path is required for unix probes")
+		}
+	case PROBE_TYPE_COMMAND:
+		if len(pc.Command) == 0 {
+			return fmt.Errorf("command is required for command probes")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", pc.Type)
+	}
+	return nil
+}
+
+func (lc *listeningConfig) finalize() error {
+	seen := make(map[expectedPortConfig]bool)
+	for _, ep := range lc.ExpectedPorts {
+		if ep.Proto == "" {
+			ep.Proto = "tcp"
+		} else if ep.Proto != "tcp" && ep.Proto != "udp" {
+			return fmt.Errorf("invalid proto %q in expected_ports", ep.Proto)
+		}
+		if ep.Port <= 0 || ep.Port > 65535 {
+			return fmt.Errorf("invalid port %d in expected_ports", ep.Port)
+		}
+		if seen[*ep] {
+			return fmt.Errorf("%s port %d listed more than once in expected_ports", ep.Proto, ep.Port)
+		}
+		seen[*ep] = true
+	}
+	return nil
+}
+
+func (tc *threadsConfig) finalize() error {
+	if tc.MaxThreads == 0 {
+		tc.MaxThreads = DEFAULT_MAX_THREADS
+	} else if tc.MaxThreads < 0 {
+		return fmt.Errorf("invalid max_threads %d", tc.MaxThreads)
+	}
+	if tc.NormalizeRegex == "" {
+		tc.NormalizeRegex = DEFAULT_THREAD_NORMALIZE_REGEX
+		tc.NormalizeReplacement = DEFAULT_THREAD_NORMALIZE_REPLACEMENT
+	}
+	var err error
+	tc.normalizeRegexp, err = regexp.Compile(tc.NormalizeRegex)
+	if err != nil {
+		return fmt.Errorf("invalid normalize_regex: %s", err)
+	}
+	return nil
+}
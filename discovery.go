@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type discoveredService struct {
+	name string
+	instance string
+
+	// Only set for systemd, e.g. "worker@1.service"
+	unit string
+}
+
+// Periodically discovers the services known to the init system, and the
+// systemd units matching the services whose names are patterns, and adds them
+// to (or removes them from) the collector.
+type serviceDiscoverer struct {
+	cfg *config
+	collector *SvcCollector
+
+	// The keys of the services currently monitored because they were
+	// discovered
+	discovered map[string]bool
+
+	discoveredServices prometheus.Gauge
+}
+
+func newServiceDiscoverer(cfg *config, collector *SvcCollector) *serviceDiscoverer {
+	return &serviceDiscoverer{
+		cfg: cfg,
+		collector: collector,
+		discovered: make(map[string]bool),
+		discoveredServices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "service_exporter_discovered_services",
+			Help: "The number of services currently monitored because they were discovered from the init system.",
+		}),
+	}
+}
+
+// Lists the jobs known to Upstart, including the instances of multi-instance
+// jobs.
+func discoverUpstartServices(ctx context.Context) ([]discoveredService, error) {
+	start := time.Now()
+	output, err := backendCommand(ctx, "initctl", "list").Output()
+	observeBackendCommand(BACKEND_UPSTART, "initctl list", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("command 'initctl list' failed: %s", err)
+	}
+	var services []discoveredService
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		s := discoveredService{name: fields[0]}
+		if strings.HasPrefix(fields[1], "(") && strings.HasSuffix(fields[1], ")") {
+			s.instance = strings.TrimSuffix(strings.TrimPrefix(fields[1], "("), ")")
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// Lists the service units loaded by systemd.
+func discoverSystemdServices(ctx context.Context) ([]discoveredService, error) {
+	cmd := backendCommand(ctx, "systemctl", "list-units", "--type=service", "--all", "--no-legend", "--plain")
+	start := time.Now()
+	output, err := cmd.Output()
+	observeBackendCommand(BACKEND_SYSTEMD, "systemctl list-units", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("command 'systemctl list-units' failed: %s", err)
+	}
+	var services []discoveredService
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasSuffix(fields[0], ".service") {
+			continue
+		}
+		// Units which don't exist but are referred to by other units
+		if fields[1] == "not-found" {
+			continue
+		}
+		name, instance := parseSystemdUnitName(fields[0])
+		services = append(services, discoveredService{
+			name: name,
+			instance: instance,
+			unit: fields[0],
+		})
+	}
+	return services, nil
+}
+
+func discoverRunitServices(serviceDir string) ([]discoveredService, error) {
+	names, err := listRunitServices(serviceDir)
+	if err != nil {
+		return nil, err
+	}
+	var services []discoveredService
+	for _, name := range names {
+		services = append(services, discoveredService{name: name})
+	}
+	return services, nil
+}
+
+// Lists the services known to the given backend.
+func discoverServices(ctx context.Context, backend string, runitServiceDir string) ([]discoveredService, error) {
+	switch backend {
+	case BACKEND_UPSTART:
+		return discoverUpstartServices(ctx)
+	case BACKEND_SYSTEMD:
+		return discoverSystemdServices(ctx)
+	case BACKEND_RUNIT:
+		return discoverRunitServices(runitServiceDir)
+	default:
+		panic(backend)
+	}
+}
+
+// Finds the systemd units matching the services whose names are patterns.
+func (d *serviceDiscoverer) expandPatterns(ctx context.Context, current map[string]*serviceConfig) error {
+	units, err := discoverSystemdServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range d.cfg.patterns {
+		for _, unit := range units {
+			if !pattern.matchesUnit(unit.unit) {
+				continue
+			}
+			svcCfg := pattern.newPatternInstanceConfig(unit.name, unit.instance)
+			if _, exists := current[svcCfg.key()]; !exists {
+				current[svcCfg.key()] = svcCfg
+			}
+		}
+	}
+	return nil
+}
+
+// Runs discovery once and updates the collector accordingly.  Services listed
+// explicitly are never affected.  Units matching a pattern are monitored with
+// the settings of the first matching pattern.  If discovery fails, the
+// previously discovered services are kept.
+func (d *serviceDiscoverer) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), DISCOVERY_TIMEOUT)
+	defer cancel()
+
+	current := make(map[string]*serviceConfig)
+	failed := false
+	if len(d.cfg.patterns) > 0 {
+		err := d.expandPatterns(ctx, current)
+		if err != nil {
+			slog.Error("could not expand service patterns", "err", err)
+			failed = true
+		}
+	}
+	if d.cfg.Discovery != nil {
+		services, err := discoverServices(ctx, d.cfg.Discovery.Backend, d.cfg.RunitServiceDir)
+		if err != nil {
+			slog.Error("could not discover services", "err", err)
+			failed = true
+		}
+		backend := d.cfg.Discovery.Backend
+		for _, s := range services {
+			svcCfg := d.cfg.newDiscoveredServiceConfig(s.name, s.instance, backend)
+			key := svcCfg.key()
+			if _, exists := current[key]; exists || !d.cfg.Discovery.matches(key) {
+				continue
+			}
+			current[key] = svcCfg
+		}
+	}
+
+	for key, svcCfg := range current {
+		if d.discovered[key] {
+			continue
+		}
+		if d.collector.addService(svcCfg) {
+			slog.Info("discovered service", "service", key)
+			d.discovered[key] = true
+		}
+	}
+	if !failed {
+		for key := range d.discovered {
+			if current[key] == nil {
+				slog.Info("service has disappeared", "service", key)
+				d.collector.removeService(key)
+				delete(d.discovered, key)
+			}
+		}
+	}
+	d.discoveredServices.Set(float64(len(d.discovered)))
+}
+
+// Runs discovery every interval, and whenever the collector notices that a
+// discovered service has disappeared.  Never returns.
+func (d *serviceDiscoverer) run() {
+	ticker := time.NewTicker(d.cfg.discoveryInterval())
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.collector.discoveryRequests:
+		}
+		d.refresh()
+	}
+}
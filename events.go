@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Service state transitions
+const (
+	EVENT_DOWN = "down"
+	EVENT_UP = "up"
+	EVENT_RESTART = "restart"
+)
+
+var serviceEvents = []string{
+	EVENT_DOWN,
+	EVENT_UP,
+	EVENT_RESTART,
+}
+
+func isValidServiceEvent(event string) bool {
+	return event == EVENT_DOWN || event == EVENT_UP || event == EVENT_RESTART
+}
+
+// The number of recent events served at /events.
+const EVENT_BUFFER_SIZE = 500
+
+// A service state transition.  "down" means that the service was seen running
+// and isn't anymore, "up" that it was seen not running and is now, and
+// "restart" that its process was replaced by another one between two checks.
+// Events are logged, served at /events and sent to webhooks as JSON.
+type serviceEvent struct {
+	Event string `json:"event"`
+	// Why the old process is gone, e.g. "process exited"
+	Reason string `json:"reason"`
+	Time time.Time `json:"time"`
+	Host string `json:"host"`
+	Service string `json:"service"`
+	Instance string `json:"instance,omitempty"`
+	Backend string `json:"backend"`
+	// The new process for "up" and "restart", and the process which is gone
+	// for "down" and "restart"; omitted if not known
+	PID int `json:"pid,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	OldPID int `json:"old_pid,omitempty"`
+	OldStartTime *time.Time `json:"old_start_time,omitempty"`
+}
+
+// Keeps the most recent events, overwriting the oldest ones once full.
+type eventBuffer struct {
+	mu sync.Mutex
+	events []*serviceEvent
+	// The index of the oldest event once the buffer is full
+	start int
+}
+
+func newEventBuffer(size int) *eventBuffer {
+	return &eventBuffer{
+		events: make([]*serviceEvent, 0, size),
+	}
+}
+
+func (b *eventBuffer) add(ev *serviceEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) < cap(b.events) {
+		b.events = append(b.events, ev)
+		return
+	}
+	b.events[b.start] = ev
+	b.start = (b.start + 1) % len(b.events)
+}
+
+// Returns the events in the buffer, oldest first.
+func (b *eventBuffer) list() []*serviceEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append(append([]*serviceEvent{}, b.events[b.start:]...), b.events[:b.start]...)
+}
+
+// Records that the service went down, came up or restarted: logs the event,
+// keeps it for /events and notifies the hooks.  The service's current process
+// is taken to be the new one; oldPid and oldStartTime (in clock ticks since
+// boot) describe the old one, and are -1 if not known.
+func (c *SvcCollector) recordEvent(svc *service, event string, reason string, oldPid int, oldStartTime int64) {
+	if c.events == nil {
+		return
+	}
+	ev := &serviceEvent{
+		Event: event,
+		Reason: reason,
+		Time: time.Now(),
+		Host: c.hostname,
+		Service: svc.name,
+		Instance: svc.instance,
+		Backend: svc.config.Backend,
+	}
+	attrs := []interface{}{
+		"event", event,
+		"reason", reason,
+		"service", svc.name,
+		"instance", svc.instance,
+		"backend", svc.config.Backend,
+	}
+	if svc.pid != -1 {
+		startTime := procStatStartTimeToTime(svc.procStatStartTime)
+		ev.PID = svc.pid
+		ev.StartTime = &startTime
+		attrs = append(attrs, "pid", ev.PID, "start_time", startTime)
+	}
+	if oldPid != -1 {
+		ev.OldPID = oldPid
+		attrs = append(attrs, "old_pid", oldPid)
+	}
+	if oldStartTime != -1 {
+		oldStart := procStatStartTimeToTime(oldStartTime)
+		ev.OldStartTime = &oldStart
+		attrs = append(attrs, "old_start_time", oldStart)
+	}
+	eventLog.Info("service " + event, attrs...)
+	c.events.add(ev)
+	for _, h := range c.hooks {
+		h.enqueue(ev)
+	}
+}
+
+// Serves /events, listing the recent events, oldest first.  The events can be
+// limited to a single service with ?service=NAME, and for instances
+// &instance=INSTANCE.
+func (c *SvcCollector) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	params := r.URL.Query()
+	name := params.Get("service")
+	instance := params.Get("instance")
+	events := []*serviceEvent{}
+	for _, ev := range c.events.list() {
+		if name != "" && (ev.Service != name || ev.Instance != instance) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": events})
+}
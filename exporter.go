@@ -1,29 +1,33 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	errServiceNotRunning = errors.New("service it not running")
+	errServiceNotRunning = errors.New("service is not running")
+	errScrapeTimeout = errors.New("timed out querying the init system")
+	errCollectorBusy = errors.New("timed out waiting for another check of the services")
 )
 
 var _SC_CLK_TCK int
+var clockTicksSource string
 
 var elog *log.Logger
 
@@ -35,6 +39,36 @@ const (
 	SM_PROCESS_VSIZE
 	SM_PROCESS_RSS
 	SM_PROCESS_UPTIME_SECONDS
+	SM_PROCESS_CPU_SECONDS
+	SM_THREAD_CPU_SECONDS
+	SM_THREAD_CONTEXT_SWITCHES
+	SM_SCHEDSTAT_RUNNING_SECONDS
+	SM_SCHEDSTAT_WAITING_SECONDS
+	SM_SCHEDSTAT_TIMESLICES
+	SM_LISTENING
+	SM_EXPECTED_PORT_LISTENING
+	SM_TCP_CONNECTIONS
+	SM_TCP_ACCEPT_QUEUE_LENGTH
+	SM_PROBE_SUCCESS
+	SM_PROBE_DURATION_SECONDS
+	SM_PROBE_HTTP_STATUS_CODE
+	SM_UNIT_STATE
+	SM_UNIT_INFO
+	SM_UPSTART_GOAL
+	SM_UPSTART_STATE
+	SM_JOB_LAST_START_TIME
+	SM_JOB_LAST_FINISH_TIME
+	SM_JOB_LAST_DURATION
+	SM_JOB_LAST_EXIT_STATUS
+	SM_JOB_LAST_SUCCESS
+	SM_JOB_NEXT_RUN_TIME
+	SM_RESTARTS
+	SM_SCRAPE_TIMED_OUT
+	SM_SCRAPE_TIMEOUTS
+	SM_UP_SECONDS
+	SM_DOWN_SECONDS
+	SM_STABILITY
+	SM_CONSECUTIVE_RESTARTS
 )
 
 const (
@@ -49,28 +83,120 @@ const (
 
 type service struct {
 	name string
+	// Only set for multi-instance Upstart jobs and instances of systemd
+	// template units
+	instance string
+	config *serviceConfig
 
 	// Constant as long as the service is up
 	pid int
 	procStatStartTime int64
 
 	// Re-populated on each scrape
-	procStatCPUSelfTime int64
-	procStatCPUTime int64
+	procStatUTime int64
+	procStatSTime int64
+	procStatCUTime int64
+	procStatCSTime int64
 	procStatVSize int64
 	procStatRSS int64
+
+	// Only populated if config.Threads is set
+	threadStats map[string]*threadStats
+	// nil if not available
+	schedstat *schedstat
+	// Only populated if config.Listening or config.TCPConnections is set
+	listeningSockets []*socketInfo
+	// Only populated if config.TCPConnections is set
+	tcpConnectionStates map[int]int
+
+	// The result of the last probe; nil if config.Probe is not set.  Not
+	// affected by reset().
+	probeResult *probeResult
+
+	// The state of the unit as last reported by systemd; nil for other
+	// backends.  Not affected by reset().
+	unitState *systemdUnitState
+	// The goal and state of the job as last reported by Upstart; nil for
+	// other backends.  Not affected by reset().
+	upstartStatus *upstartStatus
+	// Whether the init system didn't know about the discovered service when
+	// it was last asked.  Not affected by reset().
+	gone bool
+
+	// Only populated if config.Job is set.  Not affected by reset().
+	job *jobState
+
+	// Not affected by reset()
+	seenRunning bool
+	restarts int64
+	lastError string
+	lastErrorTime time.Time
+	// Whether the init system didn't answer in time during the last scrape,
+	// in which case the state from before is kept
+	scrapeTimedOut bool
+	scrapeTimeouts int64
+	// The time the service has been observed up and down, and when and in
+	// which state it was last observed.  Not affected by reset().
+	upSeconds float64
+	downSeconds float64
+	lastObservedTime time.Time
+	lastObservedUp bool
+	// When the processes found after the recent restarts started, oldest
+	// first, and the number of restarts since the service last stayed up
+	// for a while; see stability.go.  Not affected by reset().
+	restartTimes []time.Time
+	consecutiveRestarts int64
 }
 
 type SvcCollector struct {
+	// Protects services, which can be modified by service discovery, and
+	// serializes scrapes.
+	mu sync.Mutex
 	services map[string]*service
 
+	// The metrics of the last scrape, served if a scrape can't get hold of
+	// c.mu in time
+	lastMetricsMu sync.Mutex
+	lastMetrics []prometheus.Metric
+
+	// Whether to also export the deprecated CPU time metrics measured in
+	// clock ticks.
+	exportTickMetrics bool
+
 	constMetrics []prometheus.Metric
 	serviceMetrics map[int]*prometheus.Desc
+	// Observes how long scraping each service takes, unless nil
+	scrapeDuration *prometheus.HistogramVec
+
+	// The file the state is kept in across restarts, if any; see state.go
+	stateFile string
+	restoredState *savedState
+	lastSavedState *savedState
+	// The boot time of the system as a Unix timestamp, and whether the
+	// system has been rebooted since the state was saved
+	bootTime int64
+	sameBoot bool
+
+	// The recent events, and the hooks notified of them, when a service goes
+	// down, comes up or restarts; see events.go.  Events are not recorded if
+	// events is nil.
+	events *eventBuffer
+	hooks []*hook
+	// Identifies the host in the events
+	hostname string
+
+	// Signaled when a discovered service has disappeared from its init
+	// system, so that discovery doesn't have to wait for the next interval
+	// to remove it
+	discoveryRequests chan struct{}
 }
 
-func newSvcCollector(serviceNames []string) *SvcCollector {
+func newSvcCollector(serviceConfigs []*serviceConfig, exportTickMetrics bool) *SvcCollector {
 	c := &SvcCollector{
 		services: make(map[string]*service),
+		exportTickMetrics: exportTickMetrics,
+		scrapeDuration: scrapeDuration,
+		discoveryRequests: make(chan struct{}, 1),
 	}
 
 	c.constMetrics = []prometheus.Metric{
@@ -84,57 +210,283 @@ func newSvcCollector(serviceNames []string) *SvcCollector {
 			prometheus.GaugeValue,
 			float64(time.Now().Unix()),
 		),
+		prometheus.MustNewConstMetric(
+			prometheus.NewDesc(
+				"service_exporter_clock_ticks_info",
+				"The clock tick rate (CLK_TCK) used to convert values read from /proc, and where it was determined from.  Always 1.",
+				[]string{"clock_ticks", "source"},
+				nil,
+			),
+			prometheus.GaugeValue,
+			1,
+			strconv.Itoa(_SC_CLK_TCK),
+			clockTicksSource,
+		),
 	}
 
 	c.serviceMetrics = map[int]*prometheus.Desc{
 		SM_PROCESS_START: prometheus.NewDesc(
 			"service_process_start",
 			"The time at which the current process was started; -1 if currently not running.",
-			[]string{"service"},
+			[]string{"service", "instance"},
 			nil,
 		),
-		SM_PROCESS_CPU_SELF_TIME: prometheus.NewDesc(
-			"service_cpu_self_time_total",
-			"The amount of CPU time used by this process, excluding children, measured in clock ticks.",
-			[]string{"service"},
+		SM_PROCESS_CPU_SECONDS: prometheus.NewDesc(
+			"service_cpu_seconds_total",
+			"The amount of CPU time used by this process (mode user or system) and its waited-for children (mode children_user or children_system), in seconds.",
+			[]string{"service", "instance", "mode"},
 			nil,
 		),
-		SM_PROCESS_CPU_TIME: prometheus.NewDesc(
-			"service_cpu_time_total",
-			"The amount of CPU time used by this process and its waited-for children, measured in clock ticks.",
-			[]string{"service"},
+		SM_THREAD_CPU_SECONDS: prometheus.NewDesc(
+			"service_thread_cpu_seconds_total",
+			"The amount of CPU time used by the currently existing threads of this process with the given (normalized) name, in seconds.  Only exported for services with thread breakdown enabled.",
+			[]string{"service", "instance", "thread"},
+			nil,
+		),
+		SM_THREAD_CONTEXT_SWITCHES: prometheus.NewDesc(
+			"service_thread_context_switches_total",
+			"The number of voluntary or nonvoluntary context switches of the currently existing threads of this process with the given (normalized) name.  Only exported for services with thread breakdown enabled.",
+			[]string{"service", "instance", "thread", "type"},
+			nil,
+		),
+		SM_SCHEDSTAT_RUNNING_SECONDS: prometheus.NewDesc(
+			"service_schedstat_running_seconds_total",
+			"The amount of time this process has spent running on a CPU, in seconds.  Not exported if not provided by the kernel.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_SCHEDSTAT_WAITING_SECONDS: prometheus.NewDesc(
+			"service_schedstat_waiting_seconds_total",
+			"The amount of time this process has spent runnable but waiting on a run queue, in seconds.  Not exported if not provided by the kernel.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_SCHEDSTAT_TIMESLICES: prometheus.NewDesc(
+			"service_schedstat_timeslices_total",
+			"The number of timeslices this process has run on a CPU.  Not exported if not provided by the kernel.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_LISTENING: prometheus.NewDesc(
+			"service_listening",
+			"A socket this process is listening on; always 1.  Only exported for services with the listening check enabled.",
+			[]string{"service", "instance", "proto", "address", "port"},
+			nil,
+		),
+		SM_EXPECTED_PORT_LISTENING: prometheus.NewDesc(
+			"service_expected_port_listening",
+			"Whether this process is listening on the expected port; 0 if not, or if currently not running.",
+			[]string{"service", "instance", "proto", "port"},
+			nil,
+		),
+		SM_TCP_CONNECTIONS: prometheus.NewDesc(
+			"service_tcp_connections",
+			"The number of TCP connections of this process in the given state.  Only exported for services with connection counting enabled.",
+			[]string{"service", "instance", "state"},
+			nil,
+		),
+		SM_TCP_ACCEPT_QUEUE_LENGTH: prometheus.NewDesc(
+			"service_tcp_accept_queue_length",
+			"The number of connections waiting to be accepted on a listening TCP socket of this process.  Only exported for services with accept queue reporting enabled.",
+			[]string{"service", "instance", "proto", "address", "port"},
+			nil,
+		),
+		SM_PROBE_SUCCESS: prometheus.NewDesc(
+			"service_probe_success",
+			"Whether the last health probe of this service succeeded.  Only exported for services with a probe configured.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_PROBE_DURATION_SECONDS: prometheus.NewDesc(
+			"service_probe_duration_seconds",
+			"How long the last health probe of this service took, in seconds.  Only exported for services with a probe configured.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_PROBE_HTTP_STATUS_CODE: prometheus.NewDesc(
+			"service_probe_http_status_code",
+			"The HTTP status code returned to the last health probe of this service; 0 if no response was received.  Only exported for services with an http probe configured.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_UNIT_STATE: prometheus.NewDesc(
+			"service_unit_state",
+			"Whether the systemd unit of this service is in the given ActiveState; exactly one state is 1.  Only exported for systemd services.",
+			[]string{"service", "instance", "state"},
+			nil,
+		),
+		SM_UNIT_INFO: prometheus.NewDesc(
+			"service_unit_info",
+			"The SubState and Result of the systemd unit of this service; always 1.  Only exported for systemd services.",
+			[]string{"service", "instance", "sub_state", "result"},
+			nil,
+		),
+		SM_UPSTART_GOAL: prometheus.NewDesc(
+			"service_upstart_goal",
+			"Whether the Upstart job of this service has the given goal; exactly one goal is 1.  Only exported for Upstart services.",
+			[]string{"service", "instance", "goal"},
+			nil,
+		),
+		SM_UPSTART_STATE: prometheus.NewDesc(
+			"service_upstart_state",
+			"Whether the Upstart job of this service is in the given state; exactly one state is 1.  Only exported for Upstart services.",
+			[]string{"service", "instance", "state"},
+			nil,
+		),
+		SM_JOB_LAST_START_TIME: prometheus.NewDesc(
+			"service_job_last_start_time_seconds",
+			"The time at which the most recent run of this job started, which might still be in progress.  Only exported for jobs.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_JOB_LAST_FINISH_TIME: prometheus.NewDesc(
+			"service_job_last_finish_time_seconds",
+			"The time at which the most recent completed run of this job finished.  Only exported for jobs.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_JOB_LAST_DURATION: prometheus.NewDesc(
+			"service_job_last_duration_seconds",
+			"How long the most recent completed run of this job took, in seconds.  Only exported for jobs.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_JOB_LAST_EXIT_STATUS: prometheus.NewDesc(
+			"service_job_last_exit_status",
+			"The exit status of the most recent completed run of this job.  Only exported for systemd jobs.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_JOB_LAST_SUCCESS: prometheus.NewDesc(
+			"service_job_last_success",
+			"Whether the most recent completed run of this job succeeded.  Only exported for systemd jobs.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_JOB_NEXT_RUN_TIME: prometheus.NewDesc(
+			"service_job_next_run_time_seconds",
+			"The time at which the timer will next trigger this job.  Only exported for systemd jobs with an active timer.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_RESTARTS: prometheus.NewDesc(
+			"service_restarts_total",
+			"The number of times a new process was found for this service after the first one since the exporter was started.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_SCRAPE_TIMED_OUT: prometheus.NewDesc(
+			"service_scrape_timed_out",
+			"Whether querying the init system about this service timed out during this scrape, in which case the other metrics show its last known state.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_SCRAPE_TIMEOUTS: prometheus.NewDesc(
+			"service_scrape_timeouts_total",
+			"The number of scrapes during which querying the init system about this service timed out.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_UP_SECONDS: prometheus.NewDesc(
+			"service_up_seconds_total",
+			"The time this service has been observed running, accumulated between the observations of the exporter and kept across its restarts if --state.file is given.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_DOWN_SECONDS: prometheus.NewDesc(
+			"service_down_seconds_total",
+			"The time this service has been observed not running, accumulated between the observations of the exporter and kept across its restarts if --state.file is given.",
+			[]string{"service", "instance"},
+			nil,
+		),
+		SM_STABILITY: prometheus.NewDesc(
+			"service_stability",
+			"Whether the service is stable, flapping or crashlooping according to how often it has restarted recently.  Exactly one state is 1.",
+			[]string{"service", "instance", "state"},
+			nil,
+		),
+		SM_CONSECUTIVE_RESTARTS: prometheus.NewDesc(
+			"service_consecutive_restarts",
+			"The number of restarts since the service last stayed up for the crashloop window.",
+			[]string{"service", "instance"},
 			nil,
 		),
 		SM_PROCESS_VSIZE: prometheus.NewDesc(
 			"service_current_vsize",
 			"The virtual memory size of the process, in bytes; 0 if currently not running.",
-			[]string{"service"},
+			[]string{"service", "instance"},
 			nil,
 		),
 		SM_PROCESS_RSS: prometheus.NewDesc(
 			"service_current_rss",
 			"The Resident Set Size of the process; 0 if currently not running.",
-			[]string{"service"},
+			[]string{"service", "instance"},
 			nil,
 		),
 		SM_PROCESS_UPTIME_SECONDS: prometheus.NewDesc(
 			"service_process_uptime_seconds",
 			"The uptime of the process in seconds; -1 if currently not running.",
-			[]string{"service"},
+			[]string{"service", "instance"},
 			nil,
 		),
 	}
 
-	for _, svc := range serviceNames {
-		c.services[svc] = &service{
-			name: svc,
-		}
-		c.services[svc].reset()
+	if exportTickMetrics {
+		c.serviceMetrics[SM_PROCESS_CPU_SELF_TIME] = prometheus.NewDesc(
+			"service_cpu_self_time_total",
+			"DEPRECATED: use service_cpu_seconds_total.  The amount of CPU time used by this process, excluding children, measured in clock ticks.",
+			[]string{"service", "instance"},
+			nil,
+		)
+		c.serviceMetrics[SM_PROCESS_CPU_TIME] = prometheus.NewDesc(
+			"service_cpu_time_total",
+			"DEPRECATED: use service_cpu_seconds_total.  The amount of CPU time used by this process and its waited-for children, measured in clock ticks.",
+			[]string{"service", "instance"},
+			nil,
+		)
+	}
+
+	for _, svcCfg := range serviceConfigs {
+		c.addService(svcCfg)
 	}
 
 	return c
 }
 
+// Starts monitoring a service.  Returns false if a service with the same name
+// is already being monitored.
+func (c *SvcCollector) addService(svcCfg *serviceConfig) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.services[svcCfg.key()]; exists {
+		return false
+	}
+	svc := &service{
+		name: svcCfg.Name,
+		instance: svcCfg.Instance,
+		config: svcCfg,
+	}
+	svc.reset()
+	if c.restoredState != nil {
+		if s, ok := c.restoredState.Services[svcCfg.key()]; ok {
+			svc.restoreState(s, c.sameBoot)
+		}
+	}
+	c.services[svcCfg.key()] = svc
+	return true
+}
+
+func (c *SvcCollector) removeService(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if svc, exists := c.services[key]; exists && c.scrapeDuration != nil {
+		c.scrapeDuration.DeleteLabelValues(svc.name, svc.instance)
+	}
+	delete(c.services, key)
+}
+
 func (c *SvcCollector) Describe(ch chan<- *prometheus.Desc) {
 	for _, m := range c.constMetrics {
 		ch <- m.Desc()
@@ -147,11 +499,11 @@ func (c *SvcCollector) Describe(ch chan<- *prometheus.Desc) {
 func (c *SvcCollector) readProcUptimeData() []string {
 	procUptimeRawData, err := ioutil.ReadFile("/proc/uptime")
 	if err != nil {
-		elog.Fatalf("could not read /proc/uptime: %s", err)
+		fatal("could not read /proc/uptime", "err", err)
 	}
 	procUptimeData := strings.Split(string(procUptimeRawData), " ")
 	if len(procUptimeData) < 2 {
-		elog.Fatalf("unexpected /proc/uptime data")
+		fatal("unexpected /proc/uptime data", "data", string(procUptimeRawData))
 	}
 	return procUptimeData
 }
@@ -162,11 +514,13 @@ func (svc *service) readProcStatData() (procStatData []string, err error) {
 	if err != nil && os.IsNotExist(err) {
 		return nil, err
 	} else if err != nil {
-		elog.Fatalf("could not read process data for pid %d: %s", svc.pid, err)
+		fatal("could not read process data", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "err", err)
 	}
-	procStatData = strings.Split(string(procStatRawData), " ")
-	if len(procStatData) < 25 {
-		elog.Fatalf("unexpected stat data for pid %d", svc.pid)
+	// The command name can contain spaces, so splitting on them would shift
+	// the fields after it.
+	procStatData, err = parseProcStat(string(procStatRawData))
+	if err != nil {
+		fatal("unexpected process stat data", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "data", string(procStatRawData))
 	}
 	return procStatData, nil
 }
@@ -175,83 +529,99 @@ func (svc *service) reset() {
 	svc.pid = -1
 	svc.procStatStartTime = -1
 
-	svc.procStatCPUSelfTime = 0
-	svc.procStatCPUTime = 0
+	svc.procStatUTime = 0
+	svc.procStatSTime = 0
+	svc.procStatCUTime = 0
+	svc.procStatCSTime = 0
 	svc.procStatVSize = 0
 	svc.procStatRSS = 0
+
+	svc.threadStats = nil
+	svc.schedstat = nil
+	svc.listeningSockets = nil
+	svc.tcpConnectionStates = nil
 }
 
-// Verifies that a process is still running.  The returned procStatData is only
-// valid if stillRunning is true.  Calls reset() if the process is not running
-// anymore.
-func (svc *service) verifyStillRunning() (procStatData []string, stillRunning bool) {
+// Verifies that a process is still running.  If it's not, calls reset() and
+// returns why in exitReason; the returned procStatData is only valid if
+// exitReason is empty.
+func (svc *service) verifyStillRunning() (procStatData []string, exitReason string) {
 	procStatData, err := svc.readProcStatData()
 	if err != nil {
 		svc.reset()
-		return nil, false
+		return nil, "process exited"
 	}
 	currentProcStartTime, err := strconv.ParseInt(procStatData[PROC_PID_STAT_STARTTIME], 10, 64)
 	if err != nil {
-		log.Fatalf("garbage start_time for pid %d", svc.pid)
+		fatal("garbage process start time", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "start_time", procStatData[PROC_PID_STAT_STARTTIME])
 	}
 	if currentProcStartTime != svc.procStatStartTime {
 		svc.reset()
-		return nil, false
+		return nil, "process exited and its pid was reused"
 	}
-	return procStatData, true
+	return procStatData, ""
 }
 
-func (svc *service) askServiceForPID() (pid int, err error) {
-	cmd := exec.Command("service", svc.name, "status")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		errStr := err.Error()
-		if output != nil {
-			log.Printf("command 'service %s status' failed: %s", svc.name, err)
-			errStr = (strings.SplitN(string(output), "\n", 2))[0]
-		}
-		log.Printf("could not query for the status of service %s: %s", svc.name, errStr)
-		os.Exit(1)
-	}
-	commaSeparated := strings.Split(string(output), ",")
-	parts := strings.Split(commaSeparated[0], " ")
-	if len(parts) < 2 {
-		log.Printf("unexpected service status %s", string(output))
-		log.Fatalf("could not query for the status of service %s", svc.name)
+// Asks the service's init system for the PID of its main process.  Returns
+// errServiceNotRunning if the service is not running, or errScrapeTimeout if
+// the init system didn't answer before ctx expired.
+func (svc *service) askServiceForPID(ctx context.Context) (pid int, err error) {
+	switch svc.config.Backend {
+	case BACKEND_UPSTART:
+		return svc.askUpstartForPID(ctx)
+	case BACKEND_SYSTEMD:
+		return svc.askSystemdForPID(ctx)
+	case BACKEND_RUNIT:
+		return svc.askRunitForPID()
+	default:
+		panic(svc.config.Backend)
 	}
-	status := parts[len(parts) - 1]
-	if status != "start/running" {
-		return 0, errServiceNotRunning
-	}
-	if len(commaSeparated) != 2 {
-		log.Printf("unexpected service status %s", string(output))
-		log.Fatalf("could not query for the status of service %s", svc.name)
+}
+
+// Updates the status of the service as reported by its init system, without
+// looking at the PID.  Returns errScrapeTimeout if the init system didn't
+// answer before ctx expired.
+func (svc *service) refreshServiceStatus(ctx context.Context) error {
+	switch svc.config.Backend {
+	case BACKEND_UPSTART:
+		return svc.refreshUpstartStatus(ctx)
+	case BACKEND_SYSTEMD:
+		return svc.refreshSystemdUnitState(ctx)
+	case BACKEND_RUNIT:
+		// runit has no state beyond whether the process is up
+		return nil
+	default:
+		panic(svc.config.Backend)
 	}
-	parts = strings.Split(commaSeparated[1], " ")
-	pidStr := strings.TrimSpace(parts[len(parts) - 1])
-	pid, err = strconv.Atoi(pidStr)
-	if err != nil {
-		log.Fatalf("could not query for the status of service %s: unexpected PID %s", svc.name, pidStr)
+}
+
+// Records an error which occurred while scraping the service.
+func (svc *service) setError(err error) {
+	svc.lastError = err.Error()
+	svc.lastErrorTime = time.Now()
+	if err == errScrapeTimeout && !svc.scrapeTimedOut {
+		slog.Warn("timed out querying the status of service", "service", svc.name, "instance", svc.instance)
+		svc.scrapeTimedOut = true
+		svc.scrapeTimeouts++
 	}
-	return pid, nil
 }
 
 // Tries to figure out the Linux process ID (PID) for the service.  The only
-// error currently returned by this function is errServiceNotRunning; any error
-// while attempting to figure out the PID will be fatal.  The returned
-// procStatData is only valid if err is nil.
-func (svc *service) findPID() (procStatData []string, err error) {
-	svc.pid, err = svc.askServiceForPID()
-	if err == errServiceNotRunning {
+// errors currently returned by this function are errServiceNotRunning and
+// errScrapeTimeout; any other error while attempting to figure out the PID
+// will be fatal.  The returned procStatData is only valid if err is nil.
+func (svc *service) findPID(ctx context.Context) (procStatData []string, err error) {
+	svc.pid, err = svc.askServiceForPID(ctx)
+	if err == errServiceNotRunning || err == errScrapeTimeout {
 		svc.reset()
-		return nil, errServiceNotRunning
+		return nil, err
 	} else if err != nil {
 		panic(err)
 	}
 
 	procStatData, err = svc.readProcStatData()
 	if err != nil {
-		log.Printf("service %s (pid %d) has died", svc.name, svc.pid)
+		slog.Debug("process of service exited while looking it up", "service", svc.name, "instance", svc.instance, "pid", svc.pid)
 		svc.reset()
 		return nil, errServiceNotRunning
 	}
@@ -266,130 +636,747 @@ func (svc *service) findPID() (procStatData []string, err error) {
 	// will be detected on the next scrape, since the start time will have
 	// changed from what we read on this scrape.)
 
-	recheckPid, err := svc.askServiceForPID()
-	if err == errServiceNotRunning {
-		log.Printf("service %s (pid %d) has died", svc.name, svc.pid)
+	recheckPid, err := svc.askServiceForPID(ctx)
+	if err == errScrapeTimeout {
+		svc.reset()
+		return nil, err
+	} else if err == errServiceNotRunning {
+		slog.Debug("service stopped while looking it up", "service", svc.name, "instance", svc.instance, "pid", svc.pid)
 		svc.reset()
 		return nil, errServiceNotRunning
 	} else if err != nil {
 		panic(err)
 	}
 	if recheckPid != svc.pid {
-		log.Printf("service %s (pid %d) has died", svc.name, svc.pid)
+		slog.Debug("pid of service changed while looking it up", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "new_pid", recheckPid)
 		svc.reset()
 		return nil, errServiceNotRunning
 	}
 
 	svc.procStatStartTime, err = strconv.ParseInt(procStatData[PROC_PID_STAT_STARTTIME], 10, 64)
 	if err != nil {
-		log.Fatalf("garbage start_time for pid %d", svc.pid)
+		fatal("garbage process start time", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "start_time", procStatData[PROC_PID_STAT_STARTTIME])
 	}
 	return procStatData, nil
 }
 
-func (c *SvcCollector) scrape(svc *service) error {
+// Scrapes the service, querying its init system with the given context.
+func (c *SvcCollector) scrape(ctx context.Context, svc *service) error {
+	svc.scrapeTimedOut = false
+	oldPid, oldStartTime := svc.pid, svc.procStatStartTime
+	// Jobs come up and go down with every run, so only failed runs are
+	// recorded as events.
+	isJob := svc.config.Job != nil
+	if isJob {
+		wasRunning := oldPid != -1
+		defer func() { c.scrapeJob(ctx, svc, wasRunning, oldPid, oldStartTime) }()
+	}
+
 	var procStatData []string
+	// Whether the service was last seen running or not running; a restored
+	// process counts as running.  Timeouts don't change either.
+	observed := !svc.lastObservedTime.IsZero()
+	wasUp := oldPid != -1 || (observed && svc.lastObservedUp)
+	wasDown := observed && !svc.lastObservedUp
+	wasGone := svc.gone
+	defer func() {
+		if svc.gone && !wasGone {
+			c.requestDiscovery()
+		}
+	}()
+	found := false
+	restarted := false
+	exitReason := ""
 	if svc.pid != -1 {
-		var stillRunning bool
-		oldPid := svc.pid
-		procStatData, stillRunning = svc.verifyStillRunning()
-		if !stillRunning {
-			log.Printf("service %s (pid %d) has died", svc.name, oldPid)
+		procStatData, exitReason = svc.verifyStillRunning()
+		if exitReason != "" {
+			slog.Debug("process of service is gone", "service", svc.name, "instance", svc.instance, "pid", oldPid, "reason", exitReason)
 			procStatData = nil
+		} else {
+			// The job or unit can change state (e.g. to reloading or
+			// stopping) while the main process keeps running.  If the init
+			// system doesn't answer, the process is still worth scraping.
+			err := svc.refreshServiceStatus(ctx)
+			if err != nil {
+				svc.setError(err)
+			}
 		}
 	}
 	if svc.pid == -1 {
 		var err error
-		procStatData, err = svc.findPID()
+		procStatData, err = svc.findPID(ctx)
 		if err != nil {
+			svc.setError(err)
+			// After a timeout, the state of the service is unknown
+			if err == errServiceNotRunning {
+				if wasUp && !isJob {
+					if exitReason == "" {
+						exitReason = "service stopped"
+					}
+					c.recordEvent(svc, EVENT_DOWN, exitReason, oldPid, oldStartTime)
+				}
+				svc.observeAvailability(time.Now(), false, time.Time{})
+			}
 			return err
 		}
-		log.Printf("service %s running, pid %d", svc.name, svc.pid)
+		slog.Debug("found process of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid)
+		found = true
+		// Every run of a job starts a new process, which isn't a restart
+		restarted = svc.seenRunning && svc.config.Job == nil
+		svc.seenRunning = true
 	}
 	readInt64 := func(idx int) int64 {
 		val, err := strconv.ParseInt(procStatData[idx], 10, 64)
 		if err != nil {
-			log.Fatalf("garbage data at column index %d for pid %d", idx + 1, svc.pid)
+			fatal("garbage process stat data", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "column", idx + 1, "data", procStatData[idx])
 		}
 		return val
 	}
-	svc.procStatCPUSelfTime = readInt64(PROC_PID_STAT_UTIME) + readInt64(PROC_PID_STAT_STIME)
-	svc.procStatCPUTime = svc.procStatCPUSelfTime + readInt64(PROC_PID_STAT_CUTIME) + readInt64(PROC_PID_STAT_CSTIME)
+	// /proc/uptime is more precise than the boot time in /proc/stat
+	now := time.Now()
+	uptime := time.Duration(svc.uptimeSeconds(c.systemUptimeInTicks()) * float64(time.Second))
+	if restarted {
+		svc.restarts++
+		svc.recordRestart(now.Add(-uptime))
+	}
+	svc.updateConsecutiveRestarts(uptime)
+	if found && wasDown && !isJob {
+		c.recordEvent(svc, EVENT_UP, "service started", -1, -1)
+	} else if restarted {
+		if exitReason == "" {
+			exitReason = "process replaced"
+		}
+		c.recordEvent(svc, EVENT_RESTART, exitReason, oldPid, oldStartTime)
+	}
+	svc.observeAvailability(now, true, now.Add(-uptime))
+	svc.procStatUTime = readInt64(PROC_PID_STAT_UTIME)
+	svc.procStatSTime = readInt64(PROC_PID_STAT_STIME)
+	svc.procStatCUTime = readInt64(PROC_PID_STAT_CUTIME)
+	svc.procStatCSTime = readInt64(PROC_PID_STAT_CSTIME)
 	svc.procStatVSize = readInt64(PROC_PID_STAT_VSIZE)
 	svc.procStatRSS = readInt64(PROC_PID_STAT_RSS)
+	if svc.config.Threads != nil {
+		svc.scrapeThreads()
+	}
+	svc.scrapeSchedstat()
+	if svc.config.Listening != nil || svc.config.TCPConnections != nil {
+		svc.scrapeSockets()
+	}
 	return nil
 }
 
-func (c *SvcCollector) Collect(ch chan<- prometheus.Metric) {
-	for _, m := range c.constMetrics {
-		ch <- m
+// Asks the service discoverer, if any, to run as soon as possible.  Never
+// blocks.
+func (c *SvcCollector) requestDiscovery() {
+	select {
+	case c.discoveryRequests <- struct{}{}:
+	default:
 	}
+}
 
-	for _, svc := range c.services {
-		_ = c.scrape(svc)
+// Scrapes the given services and runs their probes.  Each service's init
+// system is given its scrape_timeout to answer, and each probe its timeout,
+// but no longer than until ctx expires.  Up to MAX_CONCURRENT_SCRAPES
+// services are scraped at the same time, so that a service whose init system
+// hangs doesn't use up the time the others need.  c.mu must be held.
+func (c *SvcCollector) scrapeAll(ctx context.Context, services map[string]*service) {
+	// Probes can take a while, so run them concurrently with each other and
+	// with the scrapes.
+	var probes sync.WaitGroup
+	for _, svc := range services {
+		if svc.config.Probe == nil {
+			continue
+		}
+		probes.Add(1)
+		go func(svc *service) {
+			defer probes.Done()
+			svc.probe(ctx)
+		}(svc)
+	}
+	c.scrapeServices(ctx, services)
+	probes.Wait()
+	c.saveState(false)
+}
+
+// Scrapes the given services without running their probes, up to
+// MAX_CONCURRENT_SCRAPES at the same time.  c.mu must be held.
+func (c *SvcCollector) scrapeServices(ctx context.Context, services map[string]*service) {
+	slots := make(chan struct{}, MAX_CONCURRENT_SCRAPES)
+	var scrapes sync.WaitGroup
+	for _, svc := range services {
+		slots <- struct{}{}
+		scrapes.Add(1)
+		go func(svc *service) {
+			defer func() {
+				<-slots
+				scrapes.Done()
+			}()
+			c.scrapeService(ctx, svc)
+		}(svc)
+	}
+	scrapes.Wait()
+}
+
+// Scrapes a single service without running its probe.  c.mu must be held.
+func (c *SvcCollector) scrapeService(ctx context.Context, svc *service) {
+	start := time.Now()
+	scrapeCtx, cancel := context.WithTimeout(ctx, svc.config.ScrapeTimeout)
+	_ = c.scrape(scrapeCtx, svc)
+	cancel()
+	if c.scrapeDuration != nil {
+		c.scrapeDuration.WithLabelValues(svc.name, svc.instance).Observe(time.Since(start).Seconds())
 	}
+}
+
+func (c *SvcCollector) systemUptimeInTicks() int64 {
 	procUptimeData := c.readProcUptimeData()
 	systemUptimeInSeconds, err := strconv.ParseFloat(procUptimeData[0], 64)
 	if err != nil {
-		log.Fatalf("unexpected /proc/uptime data %s", procUptimeData[0])
+		fatal("unexpected /proc/uptime data", "uptime", procUptimeData[0])
+	}
+	return int64(systemUptimeInSeconds * float64(_SC_CLK_TCK))
+}
+
+// Returns the uptime of the service's process in seconds, or -1 if it's not
+// running.
+func (svc *service) uptimeSeconds(systemUptimeInTicks int64) float64 {
+	if svc.pid == -1 {
+		return -1
+	}
+	return float64(systemUptimeInTicks - svc.procStatStartTime) / float64(_SC_CLK_TCK)
+}
+
+func (c *SvcCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch)
+}
+
+// Like Collect, but with a context limiting how long to wait for the init
+// system, and for a background check or another scrape to finish.  If ctx
+// expires before they have, the metrics of the last scrape are collected
+// instead.
+func (c *SvcCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	if !c.lockContext(ctx) {
+		slog.Warn("timed out waiting for another check of the services, serving the metrics of the last scrape")
+		c.lastMetricsMu.Lock()
+		metrics := c.lastMetrics
+		c.lastMetricsMu.Unlock()
+		for _, m := range metrics {
+			ch <- m
+		}
+		return
+	}
+	defer c.mu.Unlock()
+
+	metricsCh := make(chan prometheus.Metric)
+	go func() {
+		c.collectLocked(ctx, metricsCh)
+		close(metricsCh)
+	}()
+	var metrics []prometheus.Metric
+	for m := range metricsCh {
+		metrics = append(metrics, m)
+		ch <- m
+	}
+	c.lastMetricsMu.Lock()
+	c.lastMetrics = metrics
+	c.lastMetricsMu.Unlock()
+}
+
+// Does the work of collect.  c.mu must be held.
+func (c *SvcCollector) collectLocked(ctx context.Context, ch chan<- prometheus.Metric) {
+	for _, m := range c.constMetrics {
+		ch <- m
 	}
-	systemUptimeInTicks := int64(systemUptimeInSeconds * float64(_SC_CLK_TCK))
+
+	c.scrapeAll(ctx, c.services)
+	systemUptimeInTicks := c.systemUptimeInTicks()
 	for _, svc := range c.services {
 		ch <- prometheus.MustNewConstMetric(
 			c.serviceMetrics[SM_PROCESS_START],
 			prometheus.GaugeValue,
 			float64(svc.procStatStartTime),
 			svc.name,
+			svc.instance,
+		)
+		cpuTimes := []struct {
+			mode string
+			ticks int64
+		}{
+			{"user", svc.procStatUTime},
+			{"system", svc.procStatSTime},
+			{"children_user", svc.procStatCUTime},
+			{"children_system", svc.procStatCSTime},
+		}
+		for _, t := range cpuTimes {
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_PROCESS_CPU_SECONDS],
+				prometheus.CounterValue,
+				float64(t.ticks) / float64(_SC_CLK_TCK),
+				svc.name,
+				svc.instance,
+				t.mode,
+			)
+		}
+		if c.exportTickMetrics {
+			cpuSelfTime := svc.procStatUTime + svc.procStatSTime
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_PROCESS_CPU_SELF_TIME],
+				prometheus.CounterValue,
+				float64(cpuSelfTime),
+				svc.name,
+				svc.instance,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_PROCESS_CPU_TIME],
+				prometheus.CounterValue,
+				float64(cpuSelfTime + svc.procStatCUTime + svc.procStatCSTime),
+				svc.name,
+				svc.instance,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_PROCESS_VSIZE],
+			prometheus.GaugeValue,
+			float64(svc.procStatVSize),
+			svc.name,
+			svc.instance,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_PROCESS_RSS],
+			prometheus.GaugeValue,
+			float64(svc.procStatRSS),
+			svc.name,
+			svc.instance,
+		)
+		for thread, stats := range svc.threadStats {
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_THREAD_CPU_SECONDS],
+				prometheus.CounterValue,
+				float64(stats.cpuTicks) / float64(_SC_CLK_TCK),
+				svc.name,
+				svc.instance,
+				thread,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_THREAD_CONTEXT_SWITCHES],
+				prometheus.CounterValue,
+				float64(stats.voluntaryCtxtSwitches),
+				svc.name,
+				svc.instance,
+				thread,
+				"voluntary",
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_THREAD_CONTEXT_SWITCHES],
+				prometheus.CounterValue,
+				float64(stats.nonvoluntaryCtxtSwitches),
+				svc.name,
+				svc.instance,
+				thread,
+				"nonvoluntary",
+			)
+		}
+		if svc.schedstat != nil {
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_SCHEDSTAT_RUNNING_SECONDS],
+				prometheus.CounterValue,
+				float64(svc.schedstat.runningNanoseconds) / 1e9,
+				svc.name,
+				svc.instance,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_SCHEDSTAT_WAITING_SECONDS],
+				prometheus.CounterValue,
+				float64(svc.schedstat.waitingNanoseconds) / 1e9,
+				svc.name,
+				svc.instance,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_SCHEDSTAT_TIMESLICES],
+				prometheus.CounterValue,
+				float64(svc.schedstat.timeslices),
+				svc.name,
+				svc.instance,
+			)
+		}
+		// The same address can be listed more than once, e.g. when
+		// SO_REUSEPORT is used.
+		seenListeners := make(map[string]bool)
+		acceptQueueLengths := make(map[string]int64)
+		for _, s := range svc.listeningSockets {
+			key := s.proto + " " + s.address() + " " + s.port()
+			if s.baseProto() == "tcp" {
+				acceptQueueLengths[key] += s.rxQueue
+			}
+			if seenListeners[key] {
+				continue
+			}
+			seenListeners[key] = true
+			if svc.config.Listening != nil {
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_LISTENING],
+					prometheus.GaugeValue,
+					1,
+					svc.name,
+					svc.instance,
+					s.proto,
+					s.address(),
+					s.port(),
+				)
+			}
+		}
+		if svc.config.TCPConnections != nil && svc.config.TCPConnections.AcceptQueue {
+			for _, s := range svc.listeningSockets {
+				key := s.proto + " " + s.address() + " " + s.port()
+				queueLength, ok := acceptQueueLengths[key]
+				if !ok {
+					continue
+				}
+				delete(acceptQueueLengths, key)
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_TCP_ACCEPT_QUEUE_LENGTH],
+					prometheus.GaugeValue,
+					float64(queueLength),
+					svc.name,
+					svc.instance,
+					s.proto,
+					s.address(),
+					s.port(),
+				)
+			}
+		}
+		if svc.config.TCPConnections != nil {
+			for state, stateName := range tcpStateNames {
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_TCP_CONNECTIONS],
+					prometheus.GaugeValue,
+					float64(svc.tcpConnectionStates[state]),
+					svc.name,
+					svc.instance,
+					stateName,
+				)
+			}
+		}
+		if svc.config.Listening != nil {
+			for _, ep := range svc.config.Listening.ExpectedPorts {
+				var listening float64
+				if svc.isListeningOn(ep) {
+					listening = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_EXPECTED_PORT_LISTENING],
+					prometheus.GaugeValue,
+					listening,
+					svc.name,
+					svc.instance,
+					ep.Proto,
+					strconv.Itoa(ep.Port),
+				)
+			}
+		}
+		if svc.probeResult != nil {
+			var probeSuccess float64
+			if svc.probeResult.success {
+				probeSuccess = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_PROBE_SUCCESS],
+				prometheus.GaugeValue,
+				probeSuccess,
+				svc.name,
+				svc.instance,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_PROBE_DURATION_SECONDS],
+				prometheus.GaugeValue,
+				svc.probeResult.duration.Seconds(),
+				svc.name,
+				svc.instance,
+			)
+			if svc.config.Probe.Type == PROBE_TYPE_HTTP {
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_PROBE_HTTP_STATUS_CODE],
+					prometheus.GaugeValue,
+					float64(svc.probeResult.httpStatusCode),
+					svc.name,
+					svc.instance,
+				)
+			}
+		}
+		if svc.unitState != nil {
+			for _, state := range systemdActiveStates {
+				var inState float64
+				if svc.unitState.activeState == state {
+					inState = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_UNIT_STATE],
+					prometheus.GaugeValue,
+					inState,
+					svc.name,
+					svc.instance,
+					state,
+				)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_UNIT_INFO],
+				prometheus.GaugeValue,
+				1,
+				svc.name,
+				svc.instance,
+				svc.unitState.subState,
+				svc.unitState.result,
+			)
+		}
+		if svc.upstartStatus != nil {
+			for _, goal := range upstartGoals {
+				var hasGoal float64
+				if svc.upstartStatus.goal == goal {
+					hasGoal = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_UPSTART_GOAL],
+					prometheus.GaugeValue,
+					hasGoal,
+					svc.name,
+					svc.instance,
+					goal,
+				)
+			}
+			for _, state := range upstartStates {
+				var inState float64
+				if svc.upstartStatus.state == state {
+					inState = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					c.serviceMetrics[SM_UPSTART_STATE],
+					prometheus.GaugeValue,
+					inState,
+					svc.name,
+					svc.instance,
+					state,
+				)
+			}
+		}
+		if svc.job != nil {
+			c.collectJob(ch, svc)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_PROCESS_UPTIME_SECONDS],
+			prometheus.GaugeValue,
+			svc.uptimeSeconds(systemUptimeInTicks),
+			svc.name,
+			svc.instance,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_RESTARTS],
+			prometheus.CounterValue,
+			float64(svc.restarts),
+			svc.name,
+			svc.instance,
 		)
+		var scrapeTimedOut float64
+		if svc.scrapeTimedOut {
+			scrapeTimedOut = 1
+		}
 		ch <- prometheus.MustNewConstMetric(
-			c.serviceMetrics[SM_PROCESS_CPU_SELF_TIME],
+			c.serviceMetrics[SM_SCRAPE_TIMED_OUT],
+			prometheus.GaugeValue,
+			scrapeTimedOut,
+			svc.name,
+			svc.instance,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_SCRAPE_TIMEOUTS],
 			prometheus.CounterValue,
-			float64(svc.procStatCPUSelfTime),
+			float64(svc.scrapeTimeouts),
 			svc.name,
+			svc.instance,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			c.serviceMetrics[SM_PROCESS_CPU_TIME],
+			c.serviceMetrics[SM_UP_SECONDS],
 			prometheus.CounterValue,
-			float64(svc.procStatCPUTime),
+			svc.upSeconds,
 			svc.name,
+			svc.instance,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			c.serviceMetrics[SM_PROCESS_VSIZE],
+			c.serviceMetrics[SM_DOWN_SECONDS],
+			prometheus.CounterValue,
+			svc.downSeconds,
+			svc.name,
+			svc.instance,
+		)
+		stability := svc.stability(time.Now())
+		for _, state := range stabilityStates {
+			var value float64
+			if state == stability {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(
+				c.serviceMetrics[SM_STABILITY],
+				prometheus.GaugeValue,
+				value,
+				svc.name,
+				svc.instance,
+				state,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_CONSECUTIVE_RESTARTS],
 			prometheus.GaugeValue,
-			float64(svc.procStatVSize),
+			float64(svc.consecutiveRestarts),
 			svc.name,
+			svc.instance,
 		)
+	}
+}
+
+func (c *SvcCollector) collectJob(ch chan<- prometheus.Metric, svc *service) {
+	if !svc.job.lastStart.IsZero() {
 		ch <- prometheus.MustNewConstMetric(
-			c.serviceMetrics[SM_PROCESS_RSS],
+			c.serviceMetrics[SM_JOB_LAST_START_TIME],
 			prometheus.GaugeValue,
-			float64(svc.procStatRSS),
+			float64(svc.job.lastStart.Unix()),
 			svc.name,
+			svc.instance,
 		)
-		var serviceUptimeSeconds float64
-		if svc.pid == -1 {
-			serviceUptimeSeconds = -1
-		} else {
-			serviceUptimeSeconds = float64(systemUptimeInTicks - svc.procStatStartTime) / float64(_SC_CLK_TCK)
+	}
+	if !svc.job.lastFinish.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_JOB_LAST_FINISH_TIME],
+			prometheus.GaugeValue,
+			float64(svc.job.lastFinish.Unix()),
+			svc.name,
+			svc.instance,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_JOB_LAST_DURATION],
+			prometheus.GaugeValue,
+			svc.job.lastDuration.Seconds(),
+			svc.name,
+			svc.instance,
+		)
+	}
+	if svc.job.hasLastResult {
+		var success float64
+		if svc.job.lastSuccess {
+			success = 1
 		}
 		ch <- prometheus.MustNewConstMetric(
-			c.serviceMetrics[SM_PROCESS_UPTIME_SECONDS],
+			c.serviceMetrics[SM_JOB_LAST_EXIT_STATUS],
+			prometheus.GaugeValue,
+			float64(svc.job.lastExitStatus),
+			svc.name,
+			svc.instance,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_JOB_LAST_SUCCESS],
 			prometheus.GaugeValue,
-			float64(serviceUptimeSeconds),
+			success,
 			svc.name,
+			svc.instance,
+		)
+	}
+	if !svc.job.nextRun.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			c.serviceMetrics[SM_JOB_NEXT_RUN_TIME],
+			prometheus.GaugeValue,
+			float64(svc.job.nextRun.Unix()),
+			svc.name,
+			svc.instance,
 		)
 	}
 }
 
 func printUsage(w io.Writer) {
 	fmt.Fprintf(w, `Usage:
-  %s [--help] LISTEN_PORT SERVICENAME [...]
-`, os.Args[0])
+  %s [--help] [OPTIONS] LISTEN_PORT [SERVICENAME ...]
+  %s [--help] [OPTIONS] {--web.listen-address=ADDRESS ... | --web.systemd-socket} [SERVICENAME ...]
+  %s [--help] [OPTIONS] --textfile.directory=DIR [--textfile.interval=DURATION] [--once] [SERVICENAME ...]
+  %s [--help] [OPTIONS] --push.url=URL [--push.type=TYPE] [--push.interval=DURATION] [--push.job=JOB] [--push.label=NAME=VALUE ...] [SERVICENAME ...]
+
+Options:
+  --config=FILE       read the services to monitor and their settings from
+                      the YAML file FILE, in addition to the command line
+  --backend=BACKEND   the init system managing the services: "upstart"
+                      (the default), "systemd" or "runit"
+  --clock-ticks=N     use N as the clock tick rate (CLK_TCK) instead of
+                      reading it from the auxiliary vector or getconf
+  --cpu-tick-metrics  also export the deprecated service_cpu_self_time_total
+                      and service_cpu_time_total metrics (in clock ticks)
+  --poll.interval=DURATION
+                      how often to check on the services in the background,
+                      besides on each scrape, to account for their uptime and
+                      downtime; defaults to 15s, 0 disables
+  --state.file=FILE   keep the state of the services, such as their processes,
+                      restarts, uptime and downtime, in FILE, so that it
+                      survives restarts of the exporter
+  --log.format=FORMAT the format of the log: "logfmt" (the default) or "json"
+  --log.level=LEVEL   only log messages at LEVEL or above: "debug", "info"
+                      (the default), "warn" or "error"
+  --web.listen-address=ADDRESS
+                      instead of listening on LISTEN_PORT on all interfaces,
+                      listen on ADDRESS, either [HOST]:PORT or unix:PATH for
+                      a unix domain socket; can be repeated
+  --web.systemd-socket
+                      listen on the sockets passed by systemd socket
+                      activation (LISTEN_FDS), in addition to any given with
+                      --web.listen-address
+  --web.config.file=FILE
+                      enable TLS and/or basic authentication as configured in
+                      FILE; see README.md
+  --textfile.directory=DIR
+                      instead of listening on LISTEN_PORT, periodically write
+                      the metrics into the node_exporter textfile directory
+                      DIR
+  --textfile.interval=DURATION
+                      how often to write the metrics in textfile mode;
+                      defaults to 1m
+  --once              in textfile mode, write the metrics once and exit
+  --push.url=URL      instead of listening on LISTEN_PORT, periodically push
+                      the metrics to URL
+  --push.type=TYPE    "pushgateway" (the default) to push to the Pushgateway
+                      at URL, or "remote-write" to send them to the Prometheus
+                      remote write receiver at URL
+  --push.interval=DURATION
+                      how often to push the metrics; defaults to 1m
+  --push.job=JOB      the job label of the pushed metrics; defaults to
+                      "service_exporter"
+  --push.label=NAME=VALUE
+                      an additional label identifying the pushed metrics,
+                      besides job and host (the hostname); can be repeated
+  --push.retries=N    how many times to retry a failed push, with exponential
+                      backoff; defaults to 3
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func main() {
 	fls := flag.NewFlagSet("main", flag.ExitOnError)
 	fls.Usage = func() { printUsage(os.Stderr) }
 	printHelp := fls.Bool("help", false, "prints this help and exits")
+	configFile := fls.String("config", "", "the YAML file to read the services to monitor from")
+	defaultBackend := fls.String("backend", BACKEND_UPSTART, "the init system managing the services (upstart, systemd or runit)")
+	clockTicksOverride := fls.Int("clock-ticks", 0, "the clock tick rate (CLK_TCK) of the system; determined automatically if not set")
+	cpuTickMetrics := fls.Bool("cpu-tick-metrics", false, "also export the deprecated CPU time metrics measured in clock ticks")
+	pollInterval := fls.Duration("poll.interval", DEFAULT_POLL_INTERVAL, "how often to check on the services in the background; 0 disables")
+	stateFile := fls.String("state.file", "", "the file to keep the state of the services in across restarts")
+	logFormat := fls.String("log.format", LOG_FORMAT_LOGFMT, "the format of the log (logfmt or json)")
+	logLevel := fls.String("log.level", "info", "the minimum level of the messages to log (debug, info, warn or error)")
+	textfileDir := fls.String("textfile.directory", "", "write the metrics into this node_exporter textfile directory instead of serving them over HTTP")
+	textfileInterval := fls.Duration("textfile.interval", time.Minute, "how often to write the metrics into the textfile directory")
+	once := fls.Bool("once", false, "write the metrics into the textfile directory once and exit")
+	var listenAddresses stringsFlag
+	fls.Var(&listenAddresses, "web.listen-address", "an address to listen on, [HOST]:PORT or unix:PATH; can be given more than once")
+	systemdSocket := fls.Bool("web.systemd-socket", false, "listen on the sockets passed by systemd socket activation")
+	webConfigFile := fls.String("web.config.file", "", "the exporter-toolkit style web configuration file enabling TLS and basic authentication")
+	pushURL := fls.String("push.url", "", "push the metrics to this Pushgateway or remote write URL instead of serving them over HTTP")
+	pushType := fls.String("push.type", PUSH_TYPE_PUSHGATEWAY, "the type of the push target (pushgateway or remote-write)")
+	pushInterval := fls.Duration("push.interval", time.Minute, "how often to push the metrics")
+	pushJob := fls.String("push.job", "service_exporter", "the job label of the pushed metrics")
+	pushRetries := fls.Int("push.retries", 3, "how many times to retry a failed push")
+	pushLabels := labelsFlag{}
+	fls.Var(pushLabels, "push.label", "an additional NAME=VALUE label identifying the pushed metrics; can be given more than once")
 	err := fls.Parse(os.Args[1:])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err)
@@ -399,42 +1386,141 @@ func main() {
 		printUsage(os.Stdout)
 		os.Exit(0)
 	}
-	if len(fls.Args()) < 2 {
+	if *once && *textfileDir == "" {
+		fmt.Fprintf(os.Stderr, "--once requires --textfile.directory\n")
+		os.Exit(1)
+	}
+	if *textfileInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid --textfile.interval %s\n", *textfileInterval)
+		os.Exit(1)
+	}
+	if *textfileDir != "" && *pushURL != "" {
+		fmt.Fprintf(os.Stderr, "--textfile.directory and --push.url can not be combined\n")
+		os.Exit(1)
+	}
+	if *pushInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid --push.interval %s\n", *pushInterval)
+		os.Exit(1)
+	}
+	if *pollInterval < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --poll.interval %s\n", *pollInterval)
+		os.Exit(1)
+	}
+	// In textfile and push modes, and when the addresses to listen on are
+	// given as options, there is no LISTEN_PORT
+	args := fls.Args()
+	if *textfileDir == "" && *pushURL == "" && len(listenAddresses) == 0 && !*systemdSocket {
+		if len(args) < 1 {
+			printUsage(os.Stderr)
+			os.Exit(1)
+		}
+		listenAddresses = append(listenAddresses, net.JoinHostPort("", args[0]))
+		args = args[1:]
+	}
+	if len(args) < 1 && *configFile == "" {
 		printUsage(os.Stderr)
 		os.Exit(1)
 	}
-	listenPort := (fls.Args())[0]
-	serviceNames := (fls.Args())[1:]
+	serviceNames := args
 
-	elog = log.New(os.Stderr, "", log.LstdFlags)
-	elog.Printf("service exporter starting up")
+	elog, err = setupLogging(*logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	slog.Info("service exporter starting up", "version", version, "revision", revision)
 
-	cmd := exec.Command("getconf", "CLK_TCK")
-	sysconfOutput, err := cmd.CombinedOutput()
+	cfg := &config{}
+	if *configFile != "" {
+		cfg, err = readConfigFile(*configFile)
+		if err != nil {
+			fatal("could not read configuration", "file", *configFile, "err", err)
+		}
+	}
+	err = cfg.finalize(serviceNames, *defaultBackend)
 	if err != nil {
-		errStr := err.Error()
-		if sysconfOutput != nil {
-			log.Printf("command 'getconf CLK_TCK' failed: %s", err)
-			errStr = (strings.SplitN(string(sysconfOutput), "\n", 2))[0]
+		fatal("invalid configuration", "err", err)
+	}
+
+	var webCfg *webConfig
+	if *webConfigFile != "" {
+		webCfg, err = readWebConfigFile(*webConfigFile)
+		if err != nil {
+			fatal("could not read web configuration", "file", *webConfigFile, "err", err)
 		}
-		elog.Printf("could not query CLK_TCK from getconf: %s", errStr)
-		os.Exit(1)
 	}
-	_SC_CLK_TCK, err = strconv.Atoi(strings.TrimSpace(string(sysconfOutput)))
+
+	_SC_CLK_TCK, clockTicksSource, err = determineClockTicks(*clockTicksOverride)
 	if err != nil {
-		elog.Fatalf("could not query CLK_TCK from getconf: %s", err)
+		fatal("could not determine CLK_TCK", "err", err)
 	}
 
-	collector := newSvcCollector(serviceNames)
+	hostname, err := os.Hostname()
+	if err != nil {
+		fatal("could not determine hostname", "err", err)
+	}
+	collector := newSvcCollector(cfg.Services, *cpuTickMetrics)
+	collector.events = newEventBuffer(EVENT_BUFFER_SIZE)
+	collector.hooks = startHooks(cfg.Hooks)
+	collector.hostname = hostname
+	if *stateFile != "" {
+		err = collector.restoreState(*stateFile)
+		if err != nil {
+			fatal("could not restore state", "file", *stateFile, "err", err)
+		}
+		go collector.saveStateOnShutdown()
+	}
 
 	registry := prometheus.NewPedanticRegistry()
-	err = registry.Register(collector)
+	// When serving over HTTP, the collector is scraped by metricsHandler
+	// instead, to honor the scrape timeout
+	if *textfileDir != "" || *pushURL != "" {
+		err = registry.Register(collector)
+		if err != nil {
+			fatal("could not register collector", "err", err)
+		}
+	}
+	err = registerSelfMetrics(registry, *textfileDir == "")
 	if err != nil {
-		elog.Fatalf("ERROR:  %s", err)
+		fatal("could not register the exporter's own metrics", "err", err)
+	}
+
+	if cfg.needsDiscovery() {
+		discoverer := newServiceDiscoverer(cfg, collector)
+		discoverer.refresh()
+		go discoverer.run()
+		err = registry.Register(discoverer.discoveredServices)
+		if err != nil {
+			fatal("could not register discovery metrics", "err", err)
+		}
+	}
+	if *pollInterval > 0 && !*once {
+		go collector.poll(*pollInterval)
 	}
-	httpHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
-		ErrorLog: elog,
+	if *textfileDir != "" {
+		runTextfileMode(registry, *textfileDir, *textfileInterval, *once)
+		return
+	}
+
+	if *pushURL != "" {
+		p, err := newPusher(registry, *pushType, *pushURL, *pushJob, hostname, pushLabels, *pushRetries)
+		if err != nil {
+			fatal("invalid push configuration", "err", err)
+		}
+		p.run(*pushInterval)
+	}
+
+	http.Handle("/metrics", collector.metricsHandler(registry))
+	http.HandleFunc("/status", collector.ServeStatus)
+	http.HandleFunc("/status/", collector.ServeStatus)
+	http.HandleFunc("/events", collector.ServeEvents)
+	http.Handle("/probe", &probeHandler{
+		cfg: cfg,
+		exportTickMetrics: *cpuTickMetrics,
 	})
-	http.Handle("/metrics", httpHandler)
-	elog.Fatal(http.ListenAndServe(net.JoinHostPort("", listenPort), nil))
+	listeners, err := openListeners(listenAddresses, *systemdSocket)
+	if err != nil {
+		fatal("could not listen", "err", err)
+	}
+	fatal("could not serve HTTP", "err", serveHTTP(listeners, webCfg, http.DefaultServeMux))
 }
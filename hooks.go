@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of events which can be waiting to be notified by a hook; further
+// events are dropped.
+const HOOK_QUEUE_SIZE = 100
+
+// The delay before the first retry of a failed notification; doubled for
+// every further retry.
+const HOOK_INITIAL_BACKOFF = time.Second
+
+// Notifies a webhook or a command of service events in the background.
+type hook struct {
+	cfg *hookConfig
+	queue chan *serviceEvent
+
+	// Protects recent, the times of the events recently accepted, oldest
+	// first, for rate limiting
+	mu sync.Mutex
+	recent []time.Time
+}
+
+// Starts the hooks.
+func startHooks(hookConfigs []*hookConfig) []*hook {
+	var hooks []*hook
+	for _, hc := range hookConfigs {
+		h := &hook{
+			cfg: hc,
+			queue: make(chan *serviceEvent, HOOK_QUEUE_SIZE),
+		}
+		go h.run()
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+// Queues the event if the hook is interested in it, unless the hook's rate
+// limit has been reached or its queue is full.  Never blocks.
+func (h *hook) enqueue(ev *serviceEvent) {
+	if !h.cfg.events[ev.Event] {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(h.recent) && ev.Time.Sub(h.recent[i]) >= h.cfg.RateLimitInterval {
+		i++
+	}
+	h.recent = h.recent[i:]
+	if len(h.recent) >= h.cfg.RateLimit {
+		slog.Warn("hook rate limit reached, dropping event", "hook", h.cfg.Name, "event", ev.Event, "service", ev.Service, "instance", ev.Instance)
+		hookNotifications.WithLabelValues(h.cfg.Name, "dropped").Inc()
+		return
+	}
+	select {
+	case h.queue <- ev:
+		h.recent = append(h.recent, ev.Time)
+	default:
+		slog.Warn("hook queue full, dropping event", "hook", h.cfg.Name, "event", ev.Event, "service", ev.Service, "instance", ev.Instance)
+		hookNotifications.WithLabelValues(h.cfg.Name, "dropped").Inc()
+	}
+}
+
+// Notifies of the queued events one at a time, retrying with exponential
+// backoff if notifying fails.  Never returns.
+func (h *hook) run() {
+	for ev := range h.queue {
+		err := retryWithBackoff(h.cfg.retries, HOOK_INITIAL_BACKOFF, func() error {
+			return h.send(ev)
+		}, func(err error, backoff time.Duration) {
+			slog.Warn("could not notify hook of event, retrying", "hook", h.cfg.Name, "event", ev.Event, "service", ev.Service, "instance", ev.Instance, "err", err, "backoff", backoff.String())
+		})
+		if err != nil {
+			slog.Error("could not notify hook of event", "hook", h.cfg.Name, "event", ev.Event, "service", ev.Service, "instance", ev.Instance, "err", err)
+			hookNotifications.WithLabelValues(h.cfg.Name, "failure").Inc()
+		} else {
+			hookNotifications.WithLabelValues(h.cfg.Name, "success").Inc()
+		}
+	}
+}
+
+func (h *hook) send(ev *serviceEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+	defer cancel()
+	switch h.cfg.Type {
+	case HOOK_TYPE_WEBHOOK:
+		return h.sendWebhook(ctx, ev)
+	case HOOK_TYPE_COMMAND:
+		return h.sendCommand(ctx, ev)
+	default:
+		panic(h.cfg.Type)
+	}
+}
+
+func (h *hook) sendWebhook(ctx context.Context, ev *serviceEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Runs the hook's command with the event described in environment variables.
+func (h *hook) sendCommand(ctx context.Context, ev *serviceEvent) error {
+	env := []string{
+		"SERVICE_EXPORTER_EVENT=" + ev.Event,
+		"SERVICE_EXPORTER_REASON=" + ev.Reason,
+		"SERVICE_EXPORTER_TIME=" + ev.Time.Format(time.RFC3339),
+		"SERVICE_EXPORTER_HOST=" + ev.Host,
+		"SERVICE_EXPORTER_SERVICE=" + ev.Service,
+		"SERVICE_EXPORTER_INSTANCE=" + ev.Instance,
+		"SERVICE_EXPORTER_BACKEND=" + ev.Backend,
+	}
+	if ev.PID != 0 {
+		env = append(env, "SERVICE_EXPORTER_PID=" + strconv.Itoa(ev.PID))
+	}
+	if ev.OldPID != 0 {
+		env = append(env, "SERVICE_EXPORTER_OLD_PID=" + strconv.Itoa(ev.OldPID))
+	}
+	return runCommand(ctx, h.cfg.Command, env, h.cfg.Timeout)
+}
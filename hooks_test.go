@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func hookNotificationCount(t *testing.T, name, result string) float64 {
+	t.Helper()
+	var pb dto.Metric
+	if err := hookNotifications.WithLabelValues(name, result).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestHookRateLimit(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []*serviceEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev serviceEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("could not decode event: %s", err)
+		}
+		mu.Lock()
+		delivered = append(delivered, &ev)
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	retries := 0
+	hc := &hookConfig{
+		Name: "test-rate-limit",
+		Type: HOOK_TYPE_WEBHOOK,
+		URL: server.URL,
+		Events: []string{EVENT_DOWN, EVENT_RESTART},
+		Retries: &retries,
+		RateLimit: 3,
+		RateLimitInterval: time.Minute,
+	}
+	if err := hc.finalize(); err != nil {
+		t.Fatal(err)
+	}
+	h := &hook{
+		cfg: hc,
+		queue: make(chan *serviceEvent, HOOK_QUEUE_SIZE),
+	}
+
+	t0 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	for i, offset := range []time.Duration{
+		0,
+		time.Second,
+		2 * time.Second,
+		// Over the limit
+		3 * time.Second,
+		4 * time.Second,
+		// The first event has left the interval at its very end
+		time.Minute,
+		// But the second one hasn't yet
+		time.Minute + time.Second / 2,
+	} {
+		h.enqueue(&serviceEvent{Event: EVENT_RESTART, Time: t0.Add(offset), Service: "app", PID: 100 + i})
+	}
+	// Not notified of, so neither counted against the limit nor dropped
+	h.enqueue(&serviceEvent{Event: EVENT_UP, Time: t0.Add(2 * time.Minute), Service: "app"})
+
+	// Deliver what was queued, then return
+	close(h.queue)
+	h.run()
+
+	if dropped := hookNotificationCount(t, hc.Name, "dropped"); dropped != 3 {
+		t.Errorf("got %v dropped events, expected 3", dropped)
+	}
+	if success := hookNotificationCount(t, hc.Name, "success"); success != 4 {
+		t.Errorf("got %v successful notifications, expected 4", success)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var pids []int
+	for _, ev := range delivered {
+		pids = append(pids, ev.PID)
+	}
+	if len(pids) != 4 || pids[0] != 100 || pids[1] != 101 || pids[2] != 102 || pids[3] != 105 {
+		t.Errorf("got events for PIDs %v delivered, expected [100 101 102 105]", pids)
+	}
+}
+
+// Events are dropped rather than block the caller when the queue is full.
+func TestHookQueueFull(t *testing.T) {
+	hc := &hookConfig{
+		Name: "test-queue-full",
+		Type: HOOK_TYPE_COMMAND,
+		Command: []string{"true"},
+		RateLimit: HOOK_QUEUE_SIZE * 2,
+	}
+	if err := hc.finalize(); err != nil {
+		t.Fatal(err)
+	}
+	h := &hook{
+		cfg: hc,
+		queue: make(chan *serviceEvent, HOOK_QUEUE_SIZE),
+	}
+	t0 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < HOOK_QUEUE_SIZE + 5; i++ {
+		h.enqueue(&serviceEvent{Event: EVENT_DOWN, Time: t0.Add(time.Duration(i) * time.Millisecond), Service: "app"})
+	}
+	if len(h.queue) != HOOK_QUEUE_SIZE {
+		t.Errorf("got %d queued events, expected %d", len(h.queue), HOOK_QUEUE_SIZE)
+	}
+	if dropped := hookNotificationCount(t, hc.Name, "dropped"); dropped != 5 {
+		t.Errorf("got %v dropped events, expected 5", dropped)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Set at build time with
+// -ldflags "-X main.version=VERSION -X main.revision=REVISION"
+var (
+	version = "unknown"
+	revision = "unknown"
+)
+
+// Metrics about the exporter itself
+var (
+	scrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "service_exporter_scrape_duration_seconds",
+			Help: "How long scraping a service took, not including its probe.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service", "instance"},
+	)
+	backendCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "service_exporter_backend_commands_total",
+			Help: "The number of commands run to query the init system, e.g. \"systemctl show\".",
+		},
+		[]string{"backend", "command"},
+	)
+	backendCommandFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "service_exporter_backend_command_failures_total",
+			Help: "The number of commands run to query the init system which failed.",
+		},
+		[]string{"backend", "command"},
+	)
+	backendCommandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "service_exporter_backend_command_duration_seconds",
+			Help: "How long the commands run to query the init system took.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"backend", "command"},
+	)
+	hookNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "service_exporter_hook_notifications_total",
+			Help: "The number of service events hooks were notified of (result=\"success\"), failed to be notified of after all retries (\"failure\"), or dropped because of the rate limit or a full queue (\"dropped\").",
+		},
+		[]string{"hook", "result"},
+	)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_exporter_build_info",
+			Help: "The version and revision the service exporter was built from, and the Go version it was built with.  Always 1.",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+)
+
+// Records a command run to query the init system, which was started at start
+// and failed if err is not nil.  command identifies the kind of command, e.g.
+// "systemctl show", rather than the exact command line.
+func observeBackendCommand(backend string, command string, start time.Time, err error) {
+	backendCommandDuration.WithLabelValues(backend, command).Observe(time.Since(start).Seconds())
+	backendCommands.WithLabelValues(backend, command).Inc()
+	if err != nil {
+		backendCommandFailures.WithLabelValues(backend, command).Inc()
+	}
+}
+
+// Registers the metrics about the exporter itself.  The Go runtime and process
+// metrics are only registered if withRuntimeMetrics is set, since in textfile
+// mode they would clash with node_exporter's own.
+func registerSelfMetrics(registry *prometheus.Registry, withRuntimeMetrics bool) error {
+	buildInfo.WithLabelValues(version, revision, runtime.Version()).Set(1)
+	collectors := []prometheus.Collector{
+		scrapeDuration,
+		backendCommands,
+		backendCommandFailures,
+		backendCommandDuration,
+		hookNotifications,
+		buildInfo,
+	}
+	if withRuntimeMetrics {
+		collectors = append(collectors,
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(os.Getpid(), ""),
+		)
+	}
+	for _, c := range collectors {
+		err := registry.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What is known about the runs of a service monitored in job mode.  Zero
+// times mean unknown.
+type jobState struct {
+	// The start of the most recent run, which might still be in progress
+	lastStart time.Time
+
+	// The most recent completed run
+	lastFinish time.Time
+	lastDuration time.Duration
+	// Only known for systemd
+	hasLastResult bool
+	lastExitStatus int
+	lastSuccess bool
+
+	// Only known for systemd services triggered by a timer
+	nextRun time.Time
+}
+
+// Reads the boot time of the system from /proc/stat.
+func readBootTime() (time.Time, error) {
+	data, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			btime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("unexpected btime %s in /proc/stat", fields[1])
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
+
+// Converts a process start time read from /proc/<pid>/stat (in clock ticks
+// since boot) to wall clock time.
+func procStatStartTimeToTime(startTime int64) time.Time {
+	bootTime, err := readBootTime()
+	if err != nil {
+		fatal("could not read boot time", "err", err)
+	}
+	return bootTime.Add(time.Duration(startTime) * time.Second / time.Duration(_SC_CLK_TCK))
+}
+
+// Updates svc.job after a scrape, and records a "down" event if a run is seen
+// to have failed since the previous scrape.  wasRunning, oldPid and
+// oldStartTime describe the state of the service before the scrape.
+func (c *SvcCollector) scrapeJob(ctx context.Context, svc *service, wasRunning bool, oldPid int, oldStartTime int64) {
+	if svc.config.Backend == BACKEND_SYSTEMD {
+		// A run which failed before the first scrape is old news
+		known := svc.job != nil
+		if !known {
+			svc.job = &jobState{}
+		}
+		lastFinish := svc.job.lastFinish
+		err := svc.scrapeSystemdJob(ctx)
+		if err != nil {
+			svc.setError(err)
+		}
+		if known && svc.job.hasLastResult && !svc.job.lastSuccess && !svc.job.lastFinish.Equal(lastFinish) {
+			c.recordEvent(svc, EVENT_DOWN, fmt.Sprintf("run failed with exit status %d", svc.job.lastExitStatus), oldPid, oldStartTime)
+		}
+		return
+	}
+	if svc.job == nil {
+		svc.job = &jobState{}
+	}
+
+	// Other init systems don't keep track of past runs, so all we can do is
+	// record the transitions observed between scrapes.  Runs which start and
+	// finish between two scrapes are missed entirely, and whether a run
+	// failed is unknown.
+	restarted := svc.pid != -1 && svc.procStatStartTime != oldStartTime
+	if wasRunning && (svc.pid == -1 || restarted) {
+		svc.job.lastFinish = time.Now()
+		svc.job.lastDuration = svc.job.lastFinish.Sub(procStatStartTimeToTime(oldStartTime))
+	}
+	if svc.pid != -1 && (!wasRunning || restarted) {
+		svc.job.lastStart = procStatStartTimeToTime(svc.procStatStartTime)
+	}
+}
+
+// Returns errScrapeTimeout if systemd didn't answer in time, in which case
+// svc.job is left as it was.  The same goes for a discovered unit which has
+// been unloaded since.
+func (svc *service) scrapeSystemdJob(ctx context.Context) error {
+	values, err := svc.showServiceUnit(ctx, "ExecMainStartTimestamp", "ExecMainExitTimestamp", "ExecMainStatus", "Result")
+	if err == errServiceNotRunning {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	start, err := parseSystemdTimestamp(values["ExecMainStartTimestamp"])
+	if err != nil {
+		slog.Warn("could not query for the last run of service", "service", svc.name, "instance", svc.instance, "err", err)
+		return nil
+	}
+	exit, err := parseSystemdTimestamp(values["ExecMainExitTimestamp"])
+	if err != nil {
+		slog.Warn("could not query for the last run of service", "service", svc.name, "instance", svc.instance, "err", err)
+		return nil
+	}
+	if !start.IsZero() {
+		svc.job.lastStart = start
+	}
+	// While a run is in progress, systemd has forgotten about the previous
+	// one, so keep what we recorded earlier.
+	if !exit.IsZero() && !exit.Before(start) {
+		exitStatus, err := strconv.Atoi(values["ExecMainStatus"])
+		if err != nil {
+			slog.Warn("could not query for the last run of service: unexpected ExecMainStatus", "service", svc.name, "instance", svc.instance, "exec_main_status", values["ExecMainStatus"])
+			return nil
+		}
+		svc.job.lastFinish = exit
+		svc.job.lastDuration = exit.Sub(start)
+		svc.job.hasLastResult = true
+		svc.job.lastExitStatus = exitStatus
+		svc.job.lastSuccess = values["Result"] == "success"
+	}
+
+	timer := svc.config.Job.timerUnit(svc.config)
+	timerValues, err := svc.showSystemdUnit(ctx, timer, "LoadState", "NextElapseUSecRealtime")
+	if err != nil {
+		return err
+	}
+	svc.job.nextRun = time.Time{}
+	if timerValues["LoadState"] == "not-found" {
+		return nil
+	}
+	svc.job.nextRun, err = parseSystemdTimestamp(timerValues["NextElapseUSecRealtime"])
+	if err != nil {
+		slog.Warn("could not query for the next run of service", "service", svc.name, "instance", svc.instance, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const SD_LISTEN_FDS_START = 3
+
+// A flag which can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// Opens a listener for an address given with --web.listen-address: either
+// "unix:PATH" for a unix domain socket, or "[HOST]:PORT" for TCP.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	socketPath := strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+	if socketPath == "" {
+		return nil, fmt.Errorf("invalid listen address %q", addr)
+	}
+	// Remove a stale socket left behind by a previous run, but never any
+	// other kind of file.
+	fi, err := os.Lstat(socketPath)
+	if err == nil && fi.Mode() & os.ModeSocket != 0 {
+		err = os.Remove(socketPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socketPath)
+}
+
+// Returns the listeners passed by systemd socket activation, as described
+// in sd_listen_fds(3).
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_PID not set to our PID)")
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, fmt.Errorf("no sockets passed by systemd (LISTEN_FDS not set)")
+	}
+	var listeners []net.Listener
+	for fd := SD_LISTEN_FDS_START; fd < SD_LISTEN_FDS_START + nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_" + strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket passed by systemd as fd %d is not a listening socket: %s", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Opens all the listeners to serve on: the ones passed by systemd if
+// systemdSocket is set, followed by one for each of addrs.
+func openListeners(addrs []string, systemdSocket bool) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if systemdSocket {
+		l, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l...)
+	}
+	for _, addr := range addrs {
+		l, err := listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats
+const (
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON = "json"
+)
+
+// Logs the service events (see events.go), tagged with stream=events so that
+// they can be told apart from the rest of the log.
+var eventLog = slog.Default()
+
+// Sets up logging in the given format, "logfmt" or "json", at the given level,
+// "debug", "info", "warn" or "error".  Messages logged through the log
+// package are logged at the error level.  Returns a *log.Logger for the error
+// log of the HTTP handlers.
+func setupLogging(format string, level string) (*log.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil || strings.ContainsAny(level, "+-") {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{
+		Level: lvl,
+	}
+	var handler slog.Handler
+	switch format {
+	case LOG_FORMAT_LOGFMT:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case LOG_FORMAT_JSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	slog.SetLogLoggerLevel(slog.LevelError)
+	eventLog = slog.Default().With("stream", "events")
+	return slog.NewLogLogger(handler, slog.LevelError), nil
+}
+
+// Logs msg at the error level with the given attributes, like slog.Error, and
+// exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The maximum number of bytes of an HTTP response body matched against a
+// probe's body_regex.
+const PROBE_HTTP_MAX_BODY_SIZE = 1024 * 1024
+
+type probeResult struct {
+	success bool
+	duration time.Duration
+	// Only set for HTTP probes which received a response
+	httpStatusCode int
+	err error
+}
+
+// Runs the probe described by pc and reports the result.  Never takes
+// (much) longer than pc.Timeout, or than until ctx expires, in which case the
+// probe fails.
+func runProbe(ctx context.Context, pc *probeConfig) *probeResult {
+	probeCtx, cancel := context.WithTimeout(ctx, pc.Timeout)
+	defer cancel()
+
+	result := &probeResult{}
+	start := time.Now()
+	switch pc.Type {
+	case PROBE_TYPE_TCP:
+		result.err = probeDial(probeCtx, "tcp", pc.Address)
+	case PROBE_TYPE_UNIX:
+		result.err = probeDial(probeCtx, "unix", pc.Path)
+	case PROBE_TYPE_HTTP:
+		result.httpStatusCode, result.err = probeHTTP(probeCtx, pc)
+	case PROBE_TYPE_COMMAND:
+		result.err = runCommand(probeCtx, pc.Command, nil, pc.Timeout)
+	default:
+		panic(pc.Type)
+	}
+	result.duration = time.Since(start)
+	if result.err != nil && ctx.Err() != nil {
+		result.err = fmt.Errorf("probe aborted after %s: %s", result.duration.Round(time.Millisecond), ctx.Err())
+	}
+	result.success = result.err == nil
+	return result
+}
+
+func probeDial(ctx context.Context, network string, address string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTP(ctx context.Context, pc *probeConfig) (statusCode int, err error) {
+	req, err := http.NewRequest("GET", pc.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if pc.ExpectedStatus != 0 {
+		if resp.StatusCode != pc.ExpectedStatus {
+			return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if pc.bodyRegexp != nil {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, PROBE_HTTP_MAX_BODY_SIZE))
+		if err != nil {
+			return resp.StatusCode, fmt.Errorf("could not read response body: %s", err)
+		}
+		if !pc.bodyRegexp.Match(body) {
+			return resp.StatusCode, fmt.Errorf("response body does not match %q", pc.BodyRegex)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// Runs the probe of the service, if it has one configured, giving it no longer
+// than until ctx expires, and remembers the result.
+func (svc *service) probe(ctx context.Context) {
+	if svc.config.Probe == nil {
+		return
+	}
+	result := runProbe(ctx, svc.config.Probe)
+	if !result.success && (svc.probeResult == nil || svc.probeResult.success) {
+		slog.Warn("probe of service failed", "service", svc.name, "instance", svc.instance, "err", result.err)
+	} else if result.success && svc.probeResult != nil && !svc.probeResult.success {
+		slog.Info("probe of service succeeded", "service", svc.name, "instance", svc.instance)
+	}
+	svc.probeResult = result
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Finalizes pc like the config loader would and runs it.
+func runTestProbe(t *testing.T, pc *probeConfig) *probeResult {
+	t.Helper()
+	if err := pc.finalize(); err != nil {
+		t.Fatalf("invalid probe config: %s", err)
+	}
+	return runProbe(context.Background(), pc)
+}
+
+func expectProbeSuccess(t *testing.T, result *probeResult) {
+	t.Helper()
+	if !result.success || result.err != nil {
+		t.Errorf("probe failed: %v", result.err)
+	}
+}
+
+func expectProbeFailure(t *testing.T, result *probeResult, errSubstr string) {
+	t.Helper()
+	if result.success || result.err == nil {
+		t.Fatalf("probe succeeded, expected it to fail with %q", errSubstr)
+	}
+	if !strings.Contains(result.err.Error(), errSubstr) {
+		t.Errorf("probe failed with %q, expected %q", result.err, errSubstr)
+	}
+}
+
+// Accepts connections on l until it's closed.
+func acceptAll(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptAll(l)
+	address := l.Addr().String()
+	expectProbeSuccess(t, runTestProbe(t, &probeConfig{Type: PROBE_TYPE_TCP, Address: address}))
+
+	l.Close()
+	expectProbeFailure(t, runTestProbe(t, &probeConfig{Type: PROBE_TYPE_TCP, Address: address}), "connection refused")
+}
+
+func TestProbeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probe.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptAll(l)
+	expectProbeSuccess(t, runTestProbe(t, &probeConfig{Type: PROBE_TYPE_UNIX, Path: path}))
+
+	l.Close()
+	expectProbeFailure(t, runTestProbe(t, &probeConfig{Type: PROBE_TYPE_UNIX, Path: path}), path)
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprintln(w, "status: ok")
+		case "/unavailable":
+			http.Error(w, "status: starting", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		pc *probeConfig
+		statusCode int
+		// Empty if the probe should succeed
+		errSubstr string
+	}{
+		{
+			name: "2xx",
+			pc: &probeConfig{URL: server.URL + "/ok"},
+			statusCode: 200,
+		},
+		{
+			name: "non-2xx",
+			pc: &probeConfig{URL: server.URL + "/unavailable"},
+			statusCode: 503,
+			errSubstr: "unexpected status code 503",
+		},
+		{
+			name: "expected status",
+			pc: &probeConfig{URL: server.URL + "/unavailable", ExpectedStatus: 503},
+			statusCode: 503,
+		},
+		{
+			name: "unexpected status",
+			pc: &probeConfig{URL: server.URL + "/ok", ExpectedStatus: 204},
+			statusCode: 200,
+			errSubstr: "unexpected status code 200",
+		},
+		{
+			name: "body matches",
+			pc: &probeConfig{URL: server.URL + "/ok", BodyRegex: "status: (ok|degraded)"},
+			statusCode: 200,
+		},
+		{
+			name: "body doesn't match",
+			pc: &probeConfig{URL: server.URL + "/ok", BodyRegex: "^degraded"},
+			statusCode: 200,
+			errSubstr: `response body does not match "^degraded"`,
+		},
+		{
+			name: "body not checked on unexpected status",
+			pc: &probeConfig{URL: server.URL + "/missing", BodyRegex: "status"},
+			statusCode: 404,
+			errSubstr: "unexpected status code 404",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.pc.Type = PROBE_TYPE_HTTP
+			result := runTestProbe(t, test.pc)
+			if test.errSubstr == "" {
+				expectProbeSuccess(t, result)
+			} else {
+				expectProbeFailure(t, result, test.errSubstr)
+			}
+			if result.httpStatusCode != test.statusCode {
+				t.Errorf("got status code %d, expected %d", result.httpStatusCode, test.statusCode)
+			}
+		})
+	}
+}
+
+func TestProbeHTTPTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	result := runTestProbe(t, &probeConfig{Type: PROBE_TYPE_HTTP, URL: server.URL, Timeout: 100 * time.Millisecond})
+	expectProbeFailure(t, result, "deadline exceeded")
+	if result.httpStatusCode != 0 {
+		t.Errorf("got status code %d without a response", result.httpStatusCode)
+	}
+}
+
+func TestProbeCommand(t *testing.T) {
+	expectProbeSuccess(t, runTestProbe(t, &probeConfig{Type: PROBE_TYPE_COMMAND, Command: []string{"true"}}))
+
+	result := runTestProbe(t, &probeConfig{Type: PROBE_TYPE_COMMAND, Command: []string{"sh", "-c", "echo not ready; exit 3"}})
+	expectProbeFailure(t, result, "exit status 3: not ready")
+}
+
+func TestProbeCommandTimeout(t *testing.T) {
+	// The grandchild sleep keeps the output pipe open after sh is killed.
+	pc := &probeConfig{
+		Type: PROBE_TYPE_COMMAND,
+		Command: []string{"sh", "-c", "sleep 10; true"},
+		Timeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+	result := runTestProbe(t, pc)
+	expectProbeFailure(t, result, "command timed out after 200ms")
+	if elapsed := time.Since(start); elapsed > 3 * time.Second {
+		t.Errorf("probe took %s despite its timeout", elapsed)
+	}
+}
+
+func TestProbeContext(t *testing.T) {
+	pc := &probeConfig{
+		Type: PROBE_TYPE_COMMAND,
+		Command: []string{"sleep", "10"},
+		Timeout: 10 * time.Second,
+	}
+	if err := pc.finalize(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := runProbe(ctx, pc)
+	expectProbeFailure(t, result, "probe aborted")
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Errorf("probe took %s despite the context expiring", elapsed)
+	}
+
+	// A probe started after the context was cancelled fails right away
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go acceptAll(l)
+	result = runProbe(ctx, &probeConfig{Type: PROBE_TYPE_TCP, Address: l.Addr().String(), Timeout: time.Second})
+	expectProbeFailure(t, result, "context canceled")
+}
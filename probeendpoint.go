@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Serves /probe?service=NAME[&instance=INSTANCE][&backend=BACKEND], which
+// reports on a single service chosen by the scraper in the style of the
+// blackbox exporter, instead of on the services configured in the exporter.
+// Only services allowed by the probe_endpoint section of the configuration
+// can be probed.
+type probeHandler struct {
+	cfg *config
+	exportTickMetrics bool
+}
+
+// Reports on a single service for /probe.
+type probeCollector struct {
+	ctx context.Context
+	svcCfg *serviceConfig
+	collector *SvcCollector
+
+	probeSuccess *prometheus.Desc
+	probeDuration *prometheus.Desc
+}
+
+func newProbeCollector(ctx context.Context, svcCfg *serviceConfig, exportTickMetrics bool) *probeCollector {
+	collector := newSvcCollector([]*serviceConfig{svcCfg}, exportTickMetrics)
+	// The exporter's own metrics are on /metrics, and the services probed
+	// come and go with the requests, so their scrape durations would pile up
+	// there.
+	collector.constMetrics = nil
+	collector.scrapeDuration = nil
+	return &probeCollector{
+		ctx: ctx,
+		svcCfg: svcCfg,
+		collector: collector,
+		probeSuccess: prometheus.NewDesc(
+			"probe_success",
+			"Whether the service exists and is running, and its probe, if configured, succeeded",
+			nil,
+			nil,
+		),
+		probeDuration: prometheus.NewDesc(
+			"probe_duration_seconds",
+			"How long looking up and scraping the service took",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (pc *probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	pc.collector.Describe(ch)
+	ch <- pc.probeSuccess
+	ch <- pc.probeDuration
+}
+
+// Looks the service up in its init system first, so that a service it doesn't
+// know about is reported as failed without asking about it.
+func (pc *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	success := false
+	exists, err := serviceExists(pc.ctx, pc.svcCfg)
+	if err != nil {
+		slog.Error("could not look up service", "service", pc.svcCfg.key(), "err", err)
+	} else if exists {
+		pc.collector.collect(pc.ctx, ch)
+		svc := pc.collector.services[pc.svcCfg.key()]
+		success = svc.pid != -1 && (svc.probeResult == nil || svc.probeResult.success)
+	}
+	var successValue float64
+	if success {
+		successValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(pc.probeSuccess, prometheus.GaugeValue, successValue)
+	ch <- prometheus.MustNewConstMetric(pc.probeDuration, prometheus.GaugeValue, time.Since(start).Seconds())
+}
+
+// Whether the service is known to its init system.  Instances of Upstart jobs
+// are only known while they're running.
+func serviceExists(ctx context.Context, svcCfg *serviceConfig) (bool, error) {
+	services, err := discoverServices(ctx, svcCfg.Backend, svcCfg.runitServiceDir)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range services {
+		if s.name == svcCfg.Name && s.instance == svcCfg.Instance {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the configuration of the service to probe.  A service listed in the
+// configuration file is probed with its settings, any other with the default
+// settings, like a discovered service, so that it disappearing from its init
+// system after being looked up isn't fatal.
+func (h *probeHandler) serviceConfig(name string, instance string, backend string) (*serviceConfig, error) {
+	if backend == BACKEND_SYSTEMD && instance == "" {
+		name, instance = parseSystemdUnitName(name)
+	}
+	if strings.ContainsAny(name + instance, "*?[") {
+		return nil, fmt.Errorf("patterns can not be probed")
+	}
+	svcCfg := &serviceConfig{
+		Name: name,
+		Backend: backend,
+		Instance: instance,
+		discovered: true,
+	}
+	err := svcCfg.finalize(h.cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, configured := range h.cfg.Services {
+		if configured.Backend == backend && configured.key() == svcCfg.key() {
+			return configured, nil
+		}
+	}
+	return svcCfg, nil
+}
+
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.ProbeEndpoint == nil {
+		http.Error(w, "the probe endpoint is not enabled", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	name := params.Get("service")
+	if name == "" {
+		http.Error(w, "service parameter is missing", http.StatusBadRequest)
+		return
+	}
+	backend := params.Get("backend")
+	if backend == "" {
+		backend = h.cfg.defaultBackend
+	} else if !isValidBackend(backend) {
+		http.Error(w, "invalid backend " + backend, http.StatusBadRequest)
+		return
+	}
+	svcCfg, err := h.serviceConfig(name, params.Get("instance"), backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.cfg.ProbeEndpoint.allows(svcCfg.key()) {
+		http.Error(w, "probing service " + name + " is not allowed", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+	registry := prometheus.NewPedanticRegistry()
+	err = registry.Register(newProbeCollector(ctx, svcCfg, h.exportTickMetrics))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog: elog,
+	}).ServeHTTP(w, r)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Puts a fake systemctl running script first in $PATH for the rest of the
+// test.
+func fakeSystemctl(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "systemctl"), []byte("#!/bin/sh\n" + script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir + string(os.PathListSeparator) + os.Getenv("PATH"))
+}
+
+// Reads and finalizes the configuration like main does, with systemd as the
+// default backend.
+func readTestConfig(t *testing.T, configYAML string) *config {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+	err := ioutil.WriteFile(configFile, []byte(configYAML), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.finalize(nil, BACKEND_SYSTEMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func newTestProbeHandler(t *testing.T, configYAML string) *probeHandler {
+	t.Helper()
+	return &probeHandler{cfg: readTestConfig(t, configYAML)}
+}
+
+// A unit which is listed by systemd but gone by the time it's queried, or
+// which systemd fails to answer for, must make the probe fail rather than
+// the exporter exit.
+func TestProbeEndpointVanishedUnit(t *testing.T) {
+	tests := []struct {
+		name string
+		show string
+	}{
+		{
+			name: "unit not found",
+			show: `printf 'LoadState=not-found\nActiveState=inactive\nSubState=dead\nResult=success\nMainPID=0\n'`,
+		},
+		{
+			name: "systemctl fails",
+			show: `echo "Failed to connect to bus" >&2; exit 1`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeSystemctl(t, `
+case "$1" in
+list-units) echo "transient.service loaded active running Transient" ;;
+show) ` + test.show + ` ;;
+esac
+`)
+			h := newTestProbeHandler(t, "probe_endpoint:\n  allow: [transient]\n")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?service=transient&backend=systemd", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), "\nprobe_success 0\n") {
+				t.Errorf("probe_success 0 missing from response:\n%s", rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), `service_process_start{instance="",service="transient"} -1`) {
+				t.Errorf("service not reported as not running:\n%s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestProbeEndpointUnknownUnit(t *testing.T) {
+	fakeSystemctl(t, `
+case "$1" in
+list-units) echo "other.service loaded active running Other" ;;
+*) exit 1 ;;
+esac
+`)
+	h := newTestProbeHandler(t, "probe_endpoint:\n  allow: [transient]\n")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?service=transient&backend=systemd", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "\nprobe_success 0\n") {
+		t.Errorf("got status %d, expected probe_success 0:\n%s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Push targets
+const (
+	PUSH_TYPE_PUSHGATEWAY = "pushgateway"
+	PUSH_TYPE_REMOTE_WRITE = "remote-write"
+)
+
+const PUSH_TIMEOUT = 30 * time.Second
+
+// The delay before the first retry of a failed push; doubled for every
+// further retry.
+const PUSH_INITIAL_BACKOFF = time.Second
+
+// A set of name=value labels given on the command line.
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	var pairs []string
+	for name, value := range f {
+		pairs = append(pairs, name + "=" + value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected NAME=VALUE, got %q", s)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+type pusher struct {
+	gatherer prometheus.Gatherer
+	pushType string
+	url string
+	client *http.Client
+
+	// Identify the pushed metrics: the grouping key for the Pushgateway, or
+	// labels added to every series for remote write.  Always contains "job"
+	// and "host".
+	labels map[string]string
+
+	retries int
+}
+
+func newPusher(gatherer prometheus.Gatherer, pushType string, pushURL string, job string, hostname string, extraLabels map[string]string, retries int) (*pusher, error) {
+	if pushType != PUSH_TYPE_PUSHGATEWAY && pushType != PUSH_TYPE_REMOTE_WRITE {
+		return nil, fmt.Errorf("invalid push type %q", pushType)
+	}
+	u, err := url.Parse(pushURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid push URL %q", pushURL)
+	}
+	labels := map[string]string{
+		"job": job,
+		"host": hostname,
+	}
+	for name, value := range extraLabels {
+		labels[name] = value
+	}
+	return &pusher{
+		gatherer: gatherer,
+		pushType: pushType,
+		url: strings.TrimSuffix(pushURL, "/"),
+		client: &http.Client{Timeout: PUSH_TIMEOUT},
+		labels: labels,
+		retries: retries,
+	}, nil
+}
+
+// The sorted names of p.labels, with "job" first.
+func (p *pusher) labelNames() []string {
+	var names []string
+	for name := range p.labels {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{"job"}, names...)
+}
+
+// Returns the URL to push to.  For the Pushgateway, the grouping key is
+// appended to the path; values which can't be used in a path segment are
+// base64 encoded, and empty ones are given as "=", which the Pushgateway
+// takes to be an empty base64 encoded value.
+func (p *pusher) pushURL() string {
+	if p.pushType == PUSH_TYPE_REMOTE_WRITE {
+		return p.url
+	}
+	u := p.url + "/metrics"
+	for _, name := range p.labelNames() {
+		value := p.labels[name]
+		if value == "" {
+			u += "/" + name + "@base64/="
+		} else if strings.Contains(value, "/") {
+			u += "/" + name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+		} else {
+			u += "/" + name + "/" + url.PathEscape(value)
+		}
+	}
+	return u
+}
+
+func (p *pusher) encodePushgateway(mfs []*dto.MetricFamily) (body []byte, header http.Header, err error) {
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		_, err = expfmt.MetricFamilyToText(&buf, mf)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	header = http.Header{}
+	header.Set("Content-Type", string(expfmt.FmtText))
+	return buf.Bytes(), header, nil
+}
+
+type remoteWriteLabel struct {
+	name string
+	value string
+}
+
+type remoteWriteSeries struct {
+	labels []remoteWriteLabel
+	value float64
+	timestampMs int64
+}
+
+// Flattens the metric families into series the way Prometheus would store
+// them after a scrape, e.g. a histogram into _bucket, _sum and _count series.
+func (p *pusher) toSeries(mfs []*dto.MetricFamily, now time.Time) []*remoteWriteSeries {
+	var series []*remoteWriteSeries
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			timestampMs := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestampMs = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extraName string, extraValue string) {
+				labels := map[string]string{}
+				for name, value := range p.labels {
+					labels[name] = value
+				}
+				// Labels of the metric itself take precedence
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				if extraName != "" {
+					labels[extraName] = extraValue
+				}
+				labels["__name__"] = mf.GetName() + suffix
+				s := &remoteWriteSeries{value: value, timestampMs: timestampMs}
+				for name, value := range labels {
+					// Prometheus treats empty labels as absent
+					if value != "" {
+						s.labels = append(s.labels, remoteWriteLabel{name, value})
+					}
+				}
+				sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+				series = append(series, s)
+			}
+			formatFloat := func(f float64) string {
+				return strconv.FormatFloat(f, 'g', -1, 64)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.GetSummary().GetSampleSum(), "", "")
+				add("_count", float64(m.GetSummary().GetSampleCount()), "", "")
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.GetHistogram().GetBucket() {
+					add("_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf")
+				add("_sum", m.GetHistogram().GetSampleSum(), "", "")
+				add("_count", float64(m.GetHistogram().GetSampleCount()), "", "")
+			}
+		}
+	}
+	return series
+}
+
+// Encodes the series as a snappy-compressed prometheus.WriteRequest protobuf
+// message:
+//
+//   message WriteRequest { repeated TimeSeries timeseries = 1; }
+//   message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//   message Label { string name = 1; string value = 2; }
+//   message Sample { double value = 1; int64 timestamp = 2; }
+func (p *pusher) encodeRemoteWrite(mfs []*dto.MetricFamily) (body []byte, header http.Header, err error) {
+	const (
+		WIRE_VARINT = 0
+		WIRE_FIXED64 = 1
+		WIRE_BYTES = 2
+	)
+	tag := func(buf *proto.Buffer, field uint64, wireType uint64) {
+		_ = buf.EncodeVarint(field << 3 | wireType)
+	}
+
+	req := proto.NewBuffer(nil)
+	for _, s := range p.toSeries(mfs, time.Now()) {
+		ts := proto.NewBuffer(nil)
+		for _, l := range s.labels {
+			label := proto.NewBuffer(nil)
+			tag(label, 1, WIRE_BYTES)
+			_ = label.EncodeStringBytes(l.name)
+			tag(label, 2, WIRE_BYTES)
+			_ = label.EncodeStringBytes(l.value)
+			tag(ts, 1, WIRE_BYTES)
+			_ = ts.EncodeRawBytes(label.Bytes())
+		}
+		sample := proto.NewBuffer(nil)
+		tag(sample, 1, WIRE_FIXED64)
+		_ = sample.EncodeFixed64(math.Float64bits(s.value))
+		tag(sample, 2, WIRE_VARINT)
+		_ = sample.EncodeVarint(uint64(s.timestampMs))
+		tag(ts, 2, WIRE_BYTES)
+		_ = ts.EncodeRawBytes(sample.Bytes())
+
+		tag(req, 1, WIRE_BYTES)
+		_ = req.EncodeRawBytes(ts.Bytes())
+	}
+
+	header = http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return snappy.Encode(nil, req.Bytes()), header, nil
+}
+
+func (p *pusher) send(body []byte, header http.Header) error {
+	method := "POST"
+	if p.pushType == PUSH_TYPE_PUSHGATEWAY {
+		// replace all metrics in the group
+		method = "PUT"
+	}
+	req, err := http.NewRequest(method, p.pushURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Gathers the metrics and pushes them, retrying with exponential backoff if
+// the push fails.
+func (p *pusher) push() error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %s", err)
+	}
+	var body []byte
+	var header http.Header
+	if p.pushType == PUSH_TYPE_REMOTE_WRITE {
+		body, header, err = p.encodeRemoteWrite(mfs)
+	} else {
+		body, header, err = p.encodePushgateway(mfs)
+	}
+	if err != nil {
+		return fmt.Errorf("could not encode metrics: %s", err)
+	}
+
+	return retryWithBackoff(p.retries, PUSH_INITIAL_BACKOFF, func() error {
+		return p.send(body, header)
+	}, func(err error, backoff time.Duration) {
+		slog.Warn("could not push metrics, retrying", "url", p.url, "err", err, "backoff", backoff.String())
+	})
+}
+
+// Pushes the metrics every interval.  Never returns.
+func (p *pusher) run(interval time.Duration) {
+	for {
+		err := p.push()
+		if err != nil {
+			slog.Error("could not push metrics", "url", p.url, "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
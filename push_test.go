@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A request received by a test server.
+type pushRequest struct {
+	method string
+	// Not unescaped, as sent
+	path string
+	header http.Header
+	body []byte
+}
+
+// Starts a server which records the requests it receives and answers them with
+// the given statuses in turn, then with 200.
+func newPushServer(t *testing.T, statuses ...int) (*httptest.Server, *[]*pushRequest) {
+	var requests []*pushRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("could not read request body: %s", err)
+		}
+		requests = append(requests, &pushRequest{
+			method: r.Method,
+			path: r.URL.EscapedPath(),
+			header: r.Header,
+			body: body,
+		})
+		if len(requests) <= len(statuses) {
+			http.Error(w, "try again", statuses[len(requests) - 1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	running := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_running",
+			Help: "Whether the service is running",
+		},
+		[]string{"service", "instance"},
+	)
+	running.WithLabelValues("web", "").Set(1)
+	registry.MustRegister(running)
+	return registry
+}
+
+func TestPushgatewayPath(t *testing.T) {
+	server, requests := newPushServer(t)
+	p, err := newPusher(newTestGatherer(), PUSH_TYPE_PUSHGATEWAY, server.URL + "/", "service_exporter", "web-1", map[string]string{
+		"env": "",
+		"dc": "eu/west 1",
+		"rack": "r 7",
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, expected 1", len(*requests))
+	}
+	req := (*requests)[0]
+	if req.method != "PUT" {
+		t.Errorf("got method %s, expected PUT", req.method)
+	}
+	// job first, then the other labels sorted by name
+	expectedPath := "/metrics/job/service_exporter/dc@base64/ZXUvd2VzdCAx/env@base64/=/host/web-1/rack/r%207"
+	if req.path != expectedPath {
+		t.Errorf("got path\n%s\nexpected\n%s", req.path, expectedPath)
+	}
+	if !strings.HasPrefix(req.header.Get("Content-Type"), "text/plain") {
+		t.Errorf("got Content-Type %q", req.header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(req.body), `service_running{instance="",service="web"} 1`) {
+		t.Errorf("metric missing from body:\n%s", req.body)
+	}
+}
+
+func TestPushRetries(t *testing.T) {
+	server, requests := newPushServer(t, http.StatusServiceUnavailable)
+	p, err := newPusher(newTestGatherer(), PUSH_TYPE_PUSHGATEWAY, server.URL, "service_exporter", "web-1", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err != nil {
+		t.Fatalf("push failed despite retry: %s", err)
+	}
+	if len(*requests) != 2 {
+		t.Errorf("got %d requests, expected 2", len(*requests))
+	}
+
+	server, requests = newPushServer(t, http.StatusServiceUnavailable)
+	p, err = newPusher(newTestGatherer(), PUSH_TYPE_PUSHGATEWAY, server.URL, "service_exporter", "web-1", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.push()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, expected a 503", err)
+	}
+}
+
+// A protobuf field as found on the wire.
+type protoField struct {
+	number uint64
+	wireType uint64
+	varint uint64
+	fixed64 uint64
+	bytes []byte
+}
+
+// Decodes the fields of a protobuf message, failing the test if it's
+// malformed.
+func decodeProtoFields(t *testing.T, b []byte) []*protoField {
+	t.Helper()
+	var fields []*protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("malformed field key")
+		}
+		b = b[n:]
+		f := &protoField{number: key >> 3, wireType: key & 7}
+		switch f.wireType {
+		case 0:
+			f.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("malformed varint in field %d", f.number)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				t.Fatalf("truncated fixed64 in field %d", f.number)
+			}
+			f.fixed64 = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b) - n) < length {
+				t.Fatalf("malformed length-delimited field %d", f.number)
+			}
+			f.bytes = b[n:n + int(length)]
+			b = b[n + int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d in field %d", f.wireType, f.number)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func expectProtoField(t *testing.T, f *protoField, message string, number uint64, wireType uint64) {
+	t.Helper()
+	if f.number != number || f.wireType != wireType {
+		t.Fatalf("got field %d with wire type %d in %s, expected field %d with wire type %d", f.number, f.wireType, message, number, wireType)
+	}
+}
+
+type decodedSeries struct {
+	labels [][2]string
+	value float64
+	timestampMs int64
+}
+
+// Decodes a prometheus.WriteRequest message, checking the field numbers and
+// wire types.
+func decodeWriteRequest(t *testing.T, b []byte) []*decodedSeries {
+	t.Helper()
+	var series []*decodedSeries
+	for _, tsField := range decodeProtoFields(t, b) {
+		expectProtoField(t, tsField, "WriteRequest", 1, 2)
+		s := &decodedSeries{}
+		samples := 0
+		for _, f := range decodeProtoFields(t, tsField.bytes) {
+			switch f.number {
+			case 1:
+				expectProtoField(t, f, "TimeSeries", 1, 2)
+				labelFields := decodeProtoFields(t, f.bytes)
+				if len(labelFields) != 2 {
+					t.Fatalf("got %d fields in Label, expected 2", len(labelFields))
+				}
+				expectProtoField(t, labelFields[0], "Label", 1, 2)
+				expectProtoField(t, labelFields[1], "Label", 2, 2)
+				s.labels = append(s.labels, [2]string{string(labelFields[0].bytes), string(labelFields[1].bytes)})
+			case 2:
+				expectProtoField(t, f, "TimeSeries", 2, 2)
+				sampleFields := decodeProtoFields(t, f.bytes)
+				if len(sampleFields) != 2 {
+					t.Fatalf("got %d fields in Sample, expected 2", len(sampleFields))
+				}
+				expectProtoField(t, sampleFields[0], "Sample", 1, 1)
+				expectProtoField(t, sampleFields[1], "Sample", 2, 0)
+				s.value = math.Float64frombits(sampleFields[0].fixed64)
+				s.timestampMs = int64(sampleFields[1].varint)
+				samples++
+			default:
+				t.Fatalf("unexpected field %d in TimeSeries", f.number)
+			}
+		}
+		if samples != 1 {
+			t.Fatalf("got %d samples in TimeSeries, expected 1", samples)
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+func TestRemoteWrite(t *testing.T) {
+	server, requests := newPushServer(t)
+	registry := prometheus.NewRegistry()
+	duration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "service_exporter_scrape_duration_seconds",
+			Help: "How long scraping the service took",
+			Buckets: []float64{0.5, 2},
+		},
+		[]string{"service", "instance"},
+	)
+	duration.WithLabelValues("web", "").Observe(1)
+	registry.MustRegister(duration)
+
+	p, err := newPusher(registry, PUSH_TYPE_REMOTE_WRITE, server.URL + "/api/v1/write", "service_exporter", "web-1", map[string]string{"env": "prod"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("got %d requests, expected 1", len(*requests))
+	}
+	req := (*requests)[0]
+	if req.method != "POST" || req.path != "/api/v1/write" {
+		t.Errorf("got %s %s, expected POST /api/v1/write", req.method, req.path)
+	}
+	for name, value := range map[string]string{
+		"Content-Type": "application/x-protobuf",
+		"Content-Encoding": "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if req.header.Get(name) != value {
+			t.Errorf("got %s %q, expected %q", name, req.header.Get(name), value)
+		}
+	}
+	body, err := snappy.Decode(nil, req.body)
+	if err != nil {
+		t.Fatalf("could not decode snappy body: %s", err)
+	}
+
+	series := decodeWriteRequest(t, body)
+	// The empty instance label is left out, and the labels are sorted by
+	// name.
+	labels := func(name string, extra ...string) [][2]string {
+		l := [][2]string{{"__name__", name}, {"env", "prod"}, {"host", "web-1"}, {"job", "service_exporter"}}
+		if len(extra) > 0 {
+			l = append(l, [2]string{extra[0], extra[1]})
+		}
+		return append(l, [2]string{"service", "web"})
+	}
+	expected := []*decodedSeries{
+		{labels: labels("service_exporter_scrape_duration_seconds_bucket", "le", "0.5"), value: 0},
+		{labels: labels("service_exporter_scrape_duration_seconds_bucket", "le", "2"), value: 1},
+		{labels: labels("service_exporter_scrape_duration_seconds_bucket", "le", "+Inf"), value: 1},
+		{labels: labels("service_exporter_scrape_duration_seconds_sum"), value: 1},
+		{labels: labels("service_exporter_scrape_duration_seconds_count"), value: 1},
+	}
+	if len(series) != len(expected) {
+		t.Fatalf("got %d series, expected %d", len(series), len(expected))
+	}
+	for i, s := range series {
+		if !reflect.DeepEqual(s.labels, expected[i].labels) || s.value != expected[i].value {
+			t.Errorf("got series %v = %g, expected %v = %g", s.labels, s.value, expected[i].labels, expected[i].value)
+		}
+		if s.timestampMs <= 0 {
+			t.Errorf("got timestamp %d for series %v", s.timestampMs, s.labels)
+		}
+	}
+}
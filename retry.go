@@ -0,0 +1,22 @@
+package main
+
+import (
+	"time"
+)
+
+// Calls attempt until it succeeds, but at most retries + 1 times, and returns
+// its last error.  Waits initialBackoff before the first retry, twice as long
+// before the second one and so on, and calls onRetry with the error and the
+// backoff before each retry.
+func retryWithBackoff(retries int, initialBackoff time.Duration, attempt func() error, onRetry func(err error, backoff time.Duration)) error {
+	backoff := initialBackoff
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= retries {
+			return err
+		}
+		onRetry(err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Reads a file in the supervise directory of the service.  Any failure other
+// than the file not existing is fatal.
+func (svc *service) readRunitSuperviseFile(name string) (string, error) {
+	superviseFilePath := path.Join(svc.config.runitServiceDir, svc.name, "supervise", name)
+	data, err := ioutil.ReadFile(superviseFilePath)
+	if err != nil && os.IsNotExist(err) {
+		return "", err
+	} else if err != nil {
+		fatal("could not query for the status of service", "service", svc.name, "err", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns the PID of the service's process as recorded by runsv.  Returns
+// errServiceNotRunning unless the service is up.
+func (svc *service) askRunitForPID() (pid int, err error) {
+	stat, err := svc.readRunitSuperviseFile("stat")
+	if err != nil {
+		// runsv is not running for the service (yet)
+		return 0, errServiceNotRunning
+	}
+	// The stat file contains e.g. "run", "down" or "run, want down"
+	if !strings.HasPrefix(stat, "run") {
+		return 0, errServiceNotRunning
+	}
+	pidStr, err := svc.readRunitSuperviseFile("pid")
+	if err != nil || pidStr == "" {
+		return 0, errServiceNotRunning
+	}
+	pid, err = strconv.Atoi(pidStr)
+	if err != nil {
+		fatal("could not query for the status of service: unexpected PID", "service", svc.name, "pid", pidStr)
+	}
+	return pid, nil
+}
+
+// Lists the services in the runit service directory.
+func listRunitServices(serviceDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(serviceDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// Entries are usually symlinks to the actual service directories
+		fi, err := os.Stat(path.Join(serviceDir, entry.Name()))
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
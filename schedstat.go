@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The contents of /proc/<pid>/schedstat.
+type schedstat struct {
+	runningNanoseconds int64
+	waitingNanoseconds int64
+	timeslices int64
+}
+
+func readSchedstat(schedstatPath string) (*schedstat, error) {
+	data, err := ioutil.ReadFile(schedstatPath)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected schedstat data in %s", schedstatPath)
+	}
+	var values [3]int64
+	for i := range values {
+		values[i], err = strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("garbage data at column index %d in %s", i + 1, schedstatPath)
+		}
+	}
+	return &schedstat{
+		runningNanoseconds: values[0],
+		waitingNanoseconds: values[1],
+		timeslices: values[2],
+	}, nil
+}
+
+// Reads the scheduler statistics of the service's process.  /proc/<pid>/schedstat
+// only covers the main thread, so if the service is configured to do so, the
+// statistics of all threads are summed up instead.  svc.schedstat is left nil
+// if the statistics are not available, e.g. because the kernel was built
+// without CONFIG_SCHED_INFO.
+func (svc *service) scrapeSchedstat() {
+	svc.schedstat = nil
+
+	procPidPath := path.Join("/proc", strconv.Itoa(svc.pid))
+	if !svc.config.SchedstatAllThreads {
+		stat, err := readSchedstat(path.Join(procPidPath, "schedstat"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("could not read schedstat of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "err", err)
+			}
+			return
+		}
+		svc.schedstat = stat
+		return
+	}
+
+	taskDir := path.Join(procPidPath, "task")
+	tasks, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not list threads of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "err", err)
+		}
+		return
+	}
+	sum := &schedstat{}
+	found := false
+	for _, task := range tasks {
+		stat, err := readSchedstat(path.Join(taskDir, task.Name(), "schedstat"))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("could not read schedstat of thread of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "thread", task.Name(), "err", err)
+			}
+			continue
+		}
+		sum.runningNanoseconds += stat.runningNanoseconds
+		sum.waitingNanoseconds += stat.waitingNanoseconds
+		sum.timeslices += stat.timeslices
+		found = true
+	}
+	if found {
+		svc.schedstat = sum
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// TCP states as found in the "st" column of /proc/net/tcp, from
+// <net/tcp_states.h>.
+const (
+	TCP_ESTABLISHED int = 1 + iota
+	TCP_SYN_SENT
+	TCP_SYN_RECV
+	TCP_FIN_WAIT1
+	TCP_FIN_WAIT2
+	TCP_TIME_WAIT
+	TCP_CLOSE
+	TCP_CLOSE_WAIT
+	TCP_LAST_ACK
+	TCP_LISTEN
+	TCP_CLOSING
+	TCP_NEW_SYN_RECV
+)
+
+// The names of the TCP states as exported in the "state" label.
+var tcpStateNames = map[int]string{
+	TCP_ESTABLISHED: "ESTABLISHED",
+	TCP_SYN_SENT: "SYN_SENT",
+	TCP_SYN_RECV: "SYN_RECV",
+	TCP_FIN_WAIT1: "FIN_WAIT1",
+	TCP_FIN_WAIT2: "FIN_WAIT2",
+	TCP_TIME_WAIT: "TIME_WAIT",
+	TCP_CLOSE: "CLOSE",
+	TCP_CLOSE_WAIT: "CLOSE_WAIT",
+	TCP_LAST_ACK: "LAST_ACK",
+	TCP_CLOSING: "CLOSING",
+	TCP_NEW_SYN_RECV: "NEW_SYN_RECV",
+}
+
+// The __SO_ACCEPTCON flag in the "Flags" column of /proc/net/unix, which is
+// set on listening sockets.
+const UNIX_SO_ACCEPTCON = 0x10000
+
+// A socket as listed in one of the files in /proc/<pid>/net.
+type socketInfo struct {
+	proto string
+	inode uint64
+	state int
+
+	// Only set for TCP and UDP sockets
+	localAddr net.IP
+	localPort int
+	remoteAddr net.IP
+	remotePort int
+	rxQueue int64
+
+	// Only set for unix sockets
+	path string
+	listening bool
+}
+
+// The address of the socket as exported in the "address" label.
+func (s *socketInfo) address() string {
+	if s.proto == "unix" {
+		return s.path
+	}
+	return s.localAddr.String()
+}
+
+// The port of the socket as exported in the "port" label; empty for unix
+// sockets.
+func (s *socketInfo) port() string {
+	if s.proto == "unix" {
+		return ""
+	}
+	return strconv.Itoa(s.localPort)
+}
+
+// The protocol family of the socket without the IP version, i.e. "tcp" for
+// both "tcp" and "tcp6".
+func (s *socketInfo) baseProto() string {
+	return strings.TrimSuffix(s.proto, "6")
+}
+
+// Parses an address such as "0100007F:0050" from /proc/net/tcp.  The address
+// is printed as a sequence of 32-bit words in host byte order.
+func parseProcNetAddress(s string) (net.IP, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || (len(parts[0]) != 8 && len(parts[0]) != 32) {
+		return nil, 0, fmt.Errorf("unexpected address %q", s)
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected address %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected port in address %q", s)
+	}
+	return ip, int(port), nil
+}
+
+// Parses one of /proc/<pid>/net/{tcp,tcp6,udp,udp6}.
+func readProcNetInetSockets(filename string, proto string) ([]*socketInfo, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	var sockets []*socketInfo
+	// skip the header
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("unexpected data in %s: %q", filename, line)
+		}
+		s := &socketInfo{proto: proto}
+		s.localAddr, s.localPort, err = parseProcNetAddress(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		s.remoteAddr, s.remotePort, err = parseProcNetAddress(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		state, err := strconv.ParseInt(fields[3], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected state in %s: %q", filename, line)
+		}
+		s.state = int(state)
+		queues := strings.Split(fields[4], ":")
+		if len(queues) != 2 {
+			return nil, fmt.Errorf("unexpected queue sizes in %s: %q", filename, line)
+		}
+		s.rxQueue, err = strconv.ParseInt(queues[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected queue sizes in %s: %q", filename, line)
+		}
+		s.inode, err = strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected inode in %s: %q", filename, line)
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, nil
+}
+
+// Parses /proc/<pid>/net/unix.
+func readProcNetUnixSockets(filename string) ([]*socketInfo, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	var sockets []*socketInfo
+	// skip the header
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 7 {
+			return nil, fmt.Errorf("unexpected data in %s: %q", filename, line)
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected flags in %s: %q", filename, line)
+		}
+		state, err := strconv.ParseInt(fields[5], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected state in %s: %q", filename, line)
+		}
+		inode, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected inode in %s: %q", filename, line)
+		}
+		s := &socketInfo{
+			proto: "unix",
+			inode: inode,
+			state: int(state),
+			listening: flags & UNIX_SO_ACCEPTCON != 0,
+		}
+		if len(fields) >= 8 {
+			s.path = fields[7]
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, nil
+}
+
+// Returns the inodes of all sockets the process has open.
+func readProcPidSocketInodes(pid int) (map[uint64]bool, error) {
+	fdDir := path.Join("/proc", strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	inodes := make(map[uint64]bool)
+	for _, fd := range fds {
+		target, err := os.Readlink(path.Join(fdDir, fd.Name()))
+		if err != nil {
+			// the file descriptor was closed while we were looking
+			continue
+		}
+		if !strings.HasPrefix(target, "socket:[") || !strings.HasSuffix(target, "]") {
+			continue
+		}
+		inode, err := strconv.ParseUint(target[len("socket:[") : len(target) - 1], 10, 64)
+		if err != nil {
+			continue
+		}
+		inodes[inode] = true
+	}
+	return inodes, nil
+}
+
+// Returns all the sockets the process has open, read from the socket tables
+// of its network namespace.  Also returns the TCP sockets in that namespace
+// which are not owned by any process, such as connections in TIME_WAIT or
+// SYN_RECV.
+func readProcPidSockets(pid int) (owned []*socketInfo, unowned []*socketInfo, err error) {
+	inodes, err := readProcPidSocketInodes(pid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	procNetPath := path.Join("/proc", strconv.Itoa(pid), "net")
+	var all []*socketInfo
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		sockets, err := readProcNetInetSockets(path.Join(procNetPath, proto), proto)
+		if err != nil && os.IsNotExist(err) {
+			// e.g. IPv6 disabled
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		all = append(all, sockets...)
+	}
+	sockets, err := readProcNetUnixSockets(path.Join(procNetPath, "unix"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	all = append(all, sockets...)
+
+	for _, s := range all {
+		if inodes[s.inode] {
+			owned = append(owned, s)
+		} else if s.inode == 0 && s.baseProto() == "tcp" {
+			unowned = append(unowned, s)
+		}
+	}
+	return owned, unowned, nil
+}
+
+// Whether the socket is accepting connections (TCP and unix) or bound to a
+// local address without being connected (UDP).
+func (s *socketInfo) isListening() bool {
+	switch s.baseProto() {
+	case "tcp":
+		return s.state == TCP_LISTEN
+	case "udp":
+		return s.state == TCP_CLOSE && s.localPort != 0
+	case "unix":
+		return s.listening
+	}
+	return false
+}
+
+// Reads the sockets of the service's process and remembers the listening
+// ones, and if configured to do so, counts its TCP connections by state.
+// Connections without an owning socket (e.g. in TIME_WAIT) are attributed to
+// the service if their local port is one the service is listening on.
+func (svc *service) scrapeSockets() {
+	svc.listeningSockets = nil
+	svc.tcpConnectionStates = nil
+
+	owned, unowned, err := readProcPidSockets(svc.pid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not read sockets of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "err", err)
+		}
+		return
+	}
+	listeningTCPPorts := make(map[int]bool)
+	for _, s := range owned {
+		if s.isListening() {
+			svc.listeningSockets = append(svc.listeningSockets, s)
+			if s.baseProto() == "tcp" {
+				listeningTCPPorts[s.localPort] = true
+			}
+		}
+	}
+
+	if svc.config.TCPConnections == nil {
+		return
+	}
+	svc.tcpConnectionStates = make(map[int]int)
+	for _, s := range owned {
+		if s.baseProto() == "tcp" && s.state != TCP_LISTEN {
+			svc.tcpConnectionStates[s.state]++
+		}
+	}
+	for _, s := range unowned {
+		if s.state != TCP_LISTEN && listeningTCPPorts[s.localPort] {
+			svc.tcpConnectionStates[s.state]++
+		}
+	}
+}
+
+// Whether one of the service's listening sockets matches an expected port.
+func (svc *service) isListeningOn(ep *expectedPortConfig) bool {
+	for _, s := range svc.listeningSockets {
+		if s.baseProto() == ep.Proto && s.localPort == ep.Port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The kernel prints the addresses in /proc/net/tcp{,6} in host byte order,
+// and the fixtures below are from little-endian hosts.
+func skipUnlessLittleEndian(t *testing.T) {
+	t.Helper()
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the fixtures are from a little-endian host")
+	}
+}
+
+func writeFixture(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n") + "\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParseProcNetAddress(t *testing.T) {
+	skipUnlessLittleEndian(t)
+	tests := []struct {
+		s string
+		ip string
+		port int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"00000000:0016", "0.0.0.0", 22},
+		{"0A01A8C0:D431", "192.168.1.10", 54321},
+		{"00000000000000000000000001000000:0050", "::1", 80},
+		{"00000000000000000000000000000000:01BB", "::", 443},
+		{"B80D0120000000000000000001000000:1F90", "2001:db8::1", 8080},
+		{"0000000000000000FFFF00000100000A:0035", "10.0.0.1", 53},
+	}
+	for _, test := range tests {
+		ip, port, err := parseProcNetAddress(test.s)
+		if err != nil {
+			t.Errorf("%s: %s", test.s, err)
+			continue
+		}
+		if !ip.Equal(net.ParseIP(test.ip)) || port != test.port {
+			t.Errorf("%s: got %s port %d, expected %s port %d", test.s, ip, port, test.ip, test.port)
+		}
+	}
+
+	for _, s := range []string{
+		"0100007F1F90",
+		"0100007F:",
+		"0100007F:1F90:0",
+		"100007F:1F90",
+		"0100007G:1F90",
+		"0100007F:1FFFF",
+		"000000000000000000000000010000:0050",
+	} {
+		if ip, port, err := parseProcNetAddress(s); err == nil {
+			t.Errorf("%s: got %s port %d, expected an error", s, ip, port)
+		}
+	}
+}
+
+const procNetTCPHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode"
+
+func TestReadProcNetInetSockets(t *testing.T) {
+	skipUnlessLittleEndian(t)
+	filename := writeFixture(t, "tcp",
+		procNetTCPHeader,
+		"   0: 0100007F:1F90 00000000:0000 0A 00000000:00000003 00:00000000 00000000  1000        0 12345 1 0000000000000000 100 0 0 10 0",
+		"   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 12346 1 0000000000000000 20 4 30 10 -1",
+	)
+	sockets, err := readProcNetInetSockets(filename, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 2 {
+		t.Fatalf("got %d sockets, expected 2", len(sockets))
+	}
+	listening, established := sockets[0], sockets[1]
+	if listening.address() != "127.0.0.1" || listening.port() != "8080" || listening.state != TCP_LISTEN || listening.rxQueue != 3 || listening.inode != 12345 {
+		t.Errorf("got listening socket %+v", listening)
+	}
+	if established.state != TCP_ESTABLISHED || !established.remoteAddr.Equal(net.IPv4(127, 0, 0, 1)) || established.remotePort != 54321 || established.inode != 12346 {
+		t.Errorf("got established socket %+v", established)
+	}
+
+	filename = writeFixture(t, "tcp6",
+		"  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode",
+		"   0: 00000000000000000000000001000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 22345 1 0000000000000000 100 0 0 10 0",
+	)
+	sockets, err = readProcNetInetSockets(filename, "tcp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 1 || sockets[0].address() != "::1" || sockets[0].port() != "8080" || sockets[0].baseProto() != "tcp" || sockets[0].inode != 22345 {
+		t.Errorf("got sockets %+v", sockets)
+	}
+}
+
+func TestReadProcNetInetSocketsMalformed(t *testing.T) {
+	for name, line := range map[string]string{
+		"too few fields": "   0: 0100007F:1F90 00000000:0000 0A 00000000:00000003",
+		"bad address": "   0: 0100007F1F90 00000000:0000 0A 00000000:00000003 00:00000000 00000000  1000        0 12345",
+		"bad state": "   0: 0100007F:1F90 00000000:0000 XX 00000000:00000003 00:00000000 00000000  1000        0 12345",
+		"bad queues": "   0: 0100007F:1F90 00000000:0000 0A 00000000 00:00000000 00000000  1000        0 12345",
+		"bad inode": "   0: 0100007F:1F90 00000000:0000 0A 00000000:00000003 00:00000000 00000000  1000        0 inode",
+	} {
+		filename := writeFixture(t, "tcp", procNetTCPHeader, line)
+		if sockets, err := readProcNetInetSockets(filename, "tcp"); err == nil {
+			t.Errorf("%s: got %+v, expected an error", name, sockets)
+		}
+	}
+}
+
+const procNetUnixHeader = "Num       RefCount Protocol Flags    Type St Inode Path"
+
+func TestReadProcNetUnixSockets(t *testing.T) {
+	filename := writeFixture(t, "unix",
+		procNetUnixHeader,
+		"0000000000000000: 00000002 00000000 00010000 0001 01 23456 /run/app.sock",
+		"0000000000000000: 00000003 00000000 00000000 0001 03 23457",
+		"0000000000000000: 00000002 00000000 00010000 0001 01 23458 @abstract",
+	)
+	sockets, err := readProcNetUnixSockets(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 3 {
+		t.Fatalf("got %d sockets, expected 3", len(sockets))
+	}
+	expected := []socketInfo{
+		{proto: "unix", inode: 23456, state: 1, path: "/run/app.sock", listening: true},
+		{proto: "unix", inode: 23457, state: 3},
+		{proto: "unix", inode: 23458, state: 1, path: "@abstract", listening: true},
+	}
+	for i, s := range sockets {
+		e := expected[i]
+		if s.proto != e.proto || s.inode != e.inode || s.state != e.state || s.path != e.path || s.listening != e.listening {
+			t.Errorf("got socket %+v, expected %+v", *s, e)
+		}
+		if s.address() != e.path || s.port() != "" {
+			t.Errorf("got address %q port %q for socket %d", s.address(), s.port(), e.inode)
+		}
+	}
+
+	for name, line := range map[string]string{
+		"too few fields": "0000000000000000: 00000002 00000000 00010000 0001 01",
+		"bad flags": "0000000000000000: 00000002 00000000 zzzz 0001 01 23456 /run/app.sock",
+		"bad state": "0000000000000000: 00000002 00000000 00010000 0001 zz 23456 /run/app.sock",
+		"bad inode": "0000000000000000: 00000002 00000000 00010000 0001 01 inode /run/app.sock",
+	} {
+		filename := writeFixture(t, "unix", procNetUnixHeader, line)
+		if sockets, err := readProcNetUnixSockets(filename); err == nil {
+			t.Errorf("%s: got %+v, expected an error", name, sockets)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+)
+
+// How a service is classified according to how often it has restarted
+// recently, exported as the "state" label of service_stability.
+const (
+	STABILITY_STABLE = "stable"
+	STABILITY_FLAPPING = "flapping"
+	STABILITY_CRASHLOOPING = "crashlooping"
+)
+
+var stabilityStates = []string{
+	STABILITY_STABLE,
+	STABILITY_FLAPPING,
+	STABILITY_CRASHLOOPING,
+}
+
+// Records that the service has restarted, with its new process having started
+// at started.
+func (svc *service) recordRestart(started time.Time) {
+	sc := svc.config.Stability
+	svc.restartTimes = append(svc.restartTimes, started)
+	svc.consecutiveRestarts++
+
+	// Only the restarts within the longer of the windows are needed
+	window := sc.CrashloopWindow
+	if sc.FlappingWindow > window {
+		window = sc.FlappingWindow
+	}
+	i := 0
+	for i < len(svc.restartTimes) && started.Sub(svc.restartTimes[i]) > window {
+		i++
+	}
+	svc.restartTimes = svc.restartTimes[i:]
+}
+
+// Resets the number of consecutive restarts once the service's process has
+// stayed up for a whole crashloop window.
+func (svc *service) updateConsecutiveRestarts(uptime time.Duration) {
+	if uptime >= svc.config.Stability.CrashloopWindow {
+		svc.consecutiveRestarts = 0
+	}
+}
+
+// Classifies the service as crashlooping if it has restarted at least
+// crashloop_restarts times within the last crashloop_window, otherwise as
+// flapping if it has restarted at least flapping_restarts times within the
+// last flapping_window, and otherwise as stable.
+func (svc *service) stability(now time.Time) string {
+	sc := svc.config.Stability
+	restartsWithin := func(window time.Duration) int {
+		n := 0
+		for _, t := range svc.restartTimes {
+			if now.Sub(t) <= window {
+				n++
+			}
+		}
+		return n
+	}
+	if restartsWithin(sc.CrashloopWindow) >= sc.CrashloopRestarts {
+		return STABILITY_CRASHLOOPING
+	}
+	if restartsWithin(sc.FlappingWindow) >= sc.FlappingRestarts {
+		return STABILITY_FLAPPING
+	}
+	return STABILITY_STABLE
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newTestStabilityService() *service {
+	return &service{
+		config: &serviceConfig{
+			Stability: &stabilityConfig{
+				CrashloopRestarts: 4,
+				CrashloopWindow: 10 * time.Minute,
+				FlappingRestarts: 2,
+				FlappingWindow: time.Hour,
+			},
+		},
+	}
+}
+
+func TestStabilityFlapping(t *testing.T) {
+	svc := newTestStabilityService()
+	t0 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+	svc.recordRestart(t0)
+	if s := svc.stability(t0); s != STABILITY_STABLE {
+		t.Errorf("got %s after 1 restart, expected stable", s)
+	}
+	svc.recordRestart(t0.Add(30 * time.Minute))
+	for _, check := range []struct {
+		now time.Time
+		expected string
+	}{
+		{t0.Add(30 * time.Minute), STABILITY_FLAPPING},
+		// The first restart is still within the window at its very end
+		{t0.Add(time.Hour), STABILITY_FLAPPING},
+		{t0.Add(time.Hour + time.Second), STABILITY_STABLE},
+		{t0.Add(90 * time.Minute), STABILITY_STABLE},
+	} {
+		if s := svc.stability(check.now); s != check.expected {
+			t.Errorf("got %s at %s, expected %s", s, check.now.Sub(t0), check.expected)
+		}
+	}
+	if svc.consecutiveRestarts != 2 {
+		t.Errorf("got %d consecutive restarts, expected 2", svc.consecutiveRestarts)
+	}
+}
+
+func TestStabilityCrashlooping(t *testing.T) {
+	svc := newTestStabilityService()
+	t0 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, time.Minute, 2 * time.Minute, 10 * time.Minute} {
+		svc.recordRestart(t0.Add(offset))
+	}
+	for _, check := range []struct {
+		now time.Time
+		expected string
+	}{
+		{t0.Add(10 * time.Minute), STABILITY_CRASHLOOPING},
+		// Only 3 restarts within the crashloop window, but all 4 within the
+		// flapping window
+		{t0.Add(10 * time.Minute + time.Nanosecond), STABILITY_FLAPPING},
+		{t0.Add(61 * time.Minute), STABILITY_FLAPPING},
+		{t0.Add(70 * time.Minute + time.Second), STABILITY_STABLE},
+	} {
+		if s := svc.stability(check.now); s != check.expected {
+			t.Errorf("got %s at %s, expected %s", s, check.now.Sub(t0), check.expected)
+		}
+	}
+
+	if svc.consecutiveRestarts != 4 {
+		t.Errorf("got %d consecutive restarts, expected 4", svc.consecutiveRestarts)
+	}
+	svc.updateConsecutiveRestarts(10 * time.Minute - time.Second)
+	if svc.consecutiveRestarts != 4 {
+		t.Errorf("got %d consecutive restarts before staying up for the crashloop window, expected 4", svc.consecutiveRestarts)
+	}
+	svc.updateConsecutiveRestarts(10 * time.Minute)
+	if svc.consecutiveRestarts != 0 {
+		t.Errorf("got %d consecutive restarts after staying up for the crashloop window, expected 0", svc.consecutiveRestarts)
+	}
+}
+
+// Only the restarts within the longer of the windows are kept.
+func TestRecordRestartPrunes(t *testing.T) {
+	svc := newTestStabilityService()
+	t0 := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	svc.recordRestart(t0)
+	svc.recordRestart(t0.Add(30 * time.Minute))
+	svc.recordRestart(t0.Add(time.Hour))
+	if len(svc.restartTimes) != 3 {
+		t.Errorf("got %d restart times, expected 3", len(svc.restartTimes))
+	}
+	svc.recordRestart(t0.Add(time.Hour + time.Second))
+	if len(svc.restartTimes) != 3 || !svc.restartTimes[0].Equal(t0.Add(30 * time.Minute)) {
+		t.Errorf("got restart times %v, expected the first one to be dropped", svc.restartTimes)
+	}
+	if svc.consecutiveRestarts != 4 {
+		t.Errorf("got %d consecutive restarts, expected 4", svc.consecutiveRestarts)
+	}
+}
+
+// The restarts show up in service_stability and service_consecutive_restarts.
+func TestStabilityMetrics(t *testing.T) {
+	// A runit service without a supervise directory is simply not running,
+	// so scraping it doesn't need an init system.
+	cfg := readTestConfig(t, "runit_service_dir: " + t.TempDir() + "\n" +
+		"services:\n" +
+		"  - name: app\n" +
+		"    backend: runit\n" +
+		"    stability: {flapping_restarts: 2, flapping_window: 1h}\n")
+	c := newSvcCollector(cfg.Services, false)
+	now := time.Now()
+	svc := c.services["app"]
+	svc.recordRestart(now.Add(-59 * time.Minute))
+	svc.recordRestart(now.Add(-30 * time.Minute))
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.collect(context.Background(), ch)
+		close(ch)
+	}()
+	stability := map[string]float64{}
+	consecutiveRestarts := -1.0
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		switch m.Desc() {
+		case c.serviceMetrics[SM_STABILITY]:
+			for _, lp := range pb.GetLabel() {
+				if lp.GetName() == "state" {
+					stability[lp.GetValue()] = pb.GetGauge().GetValue()
+				}
+			}
+		case c.serviceMetrics[SM_CONSECUTIVE_RESTARTS]:
+			consecutiveRestarts = pb.GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		STABILITY_STABLE: 0,
+		STABILITY_FLAPPING: 1,
+		STABILITY_CRASHLOOPING: 0,
+	}
+	for state, value := range expected {
+		if v, ok := stability[state]; !ok || v != value {
+			t.Errorf("got service_stability{state=%q} %v, expected %v", state, v, value)
+		}
+	}
+	if consecutiveRestarts != 2 {
+		t.Errorf("got service_consecutive_restarts %v, expected 2", consecutiveRestarts)
+	}
+}
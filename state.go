@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// How much the boot time read from /proc/stat may differ from the one in the
+// state file for the system to be considered not rebooted.  The boot time is
+// derived from the current time, so it moves when the clock is adjusted.
+const BOOT_TIME_TOLERANCE = 5 * time.Second
+
+// The state of the collector which is kept across restarts of the exporter
+// in the file given with --state.file.
+type savedState struct {
+	// The boot time of the system as a Unix timestamp, since the start times
+	// of processes are relative to it
+	BootTime int64 `json:"boot_time"`
+
+	// Keyed by serviceConfig.key()
+	Services map[string]*savedServiceState `json:"services"`
+}
+
+type savedServiceState struct {
+	// The main process of the service as last seen; PID is -1 if it wasn't
+	// running.  StartTime is in clock ticks since boot, as in
+	// /proc/<pid>/stat.
+	PID int `json:"pid"`
+	StartTime int64 `json:"start_time"`
+
+	SeenRunning bool `json:"seen_running"`
+	Restarts int64 `json:"restarts"`
+	ScrapeTimeouts int64 `json:"scrape_timeouts"`
+	UpSeconds float64 `json:"up_seconds"`
+	DownSeconds float64 `json:"down_seconds"`
+	RestartTimes []time.Time `json:"restart_times,omitempty"`
+	ConsecutiveRestarts int64 `json:"consecutive_restarts"`
+}
+
+// Reads the state file.  A missing file is not an error, since there is none
+// before the exporter runs for the first time.
+func readStateFile(filename string) (*savedState, error) {
+	state := &savedState{
+		Services: make(map[string]*savedServiceState),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	if state.Services == nil {
+		state.Services = make(map[string]*savedServiceState)
+	}
+	return state, nil
+}
+
+// Whether the state is the same as other, not counting the time accounted as
+// up or down, which changes continuously.
+func (s *savedState) sameAs(other *savedState) bool {
+	if other == nil || s.BootTime != other.BootTime || len(s.Services) != len(other.Services) {
+		return false
+	}
+	for key, ss := range s.Services {
+		otherSS, ok := other.Services[key]
+		if !ok {
+			return false
+		}
+		a, b := *ss, *otherSS
+		a.UpSeconds, a.DownSeconds = 0, 0
+		b.UpSeconds, b.DownSeconds = 0, 0
+		if !reflect.DeepEqual(a, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// Restores the state of the services from the state file left by a previous
+// run of the exporter, and keeps the state in the file from now on.  Services
+// added later, e.g. by discovery, are restored when they're added.
+func (c *SvcCollector) restoreState(filename string) error {
+	state, err := readStateFile(filename)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stateFile = filename
+	c.restoredState = state
+	c.lastSavedState = state
+	bootTime, err := readBootTime()
+	if err != nil {
+		return fmt.Errorf("could not read boot time: %s", err)
+	}
+	// Keep the boot time the processes were saved with unless the system has
+	// been rebooted since, so that it doesn't drift within the tolerance.
+	diff := bootTime.Sub(time.Unix(state.BootTime, 0))
+	c.sameBoot = diff > -BOOT_TIME_TOLERANCE && diff < BOOT_TIME_TOLERANCE
+	c.bootTime = bootTime.Unix()
+	if c.sameBoot {
+		c.bootTime = state.BootTime
+	}
+	for key, svc := range c.services {
+		if s, ok := state.Services[key]; ok {
+			svc.restoreState(s, c.sameBoot)
+		}
+	}
+	return nil
+}
+
+// Restores the state of the service.  The process is only restored if the
+// system hasn't been rebooted since, and the next scrape will find out
+// whether it's still running, so that restarts which happened in the meantime
+// are counted (even if there were several, they're counted as one).  After a
+// reboot, any process found is counted as a restart.
+func (svc *service) restoreState(s *savedServiceState, sameBoot bool) {
+	svc.seenRunning = s.SeenRunning
+	svc.restarts = s.Restarts
+	svc.scrapeTimeouts = s.ScrapeTimeouts
+	svc.upSeconds = s.UpSeconds
+	svc.downSeconds = s.DownSeconds
+	svc.restartTimes = s.RestartTimes
+	svc.consecutiveRestarts = s.ConsecutiveRestarts
+	if sameBoot && s.PID > 0 {
+		svc.pid = s.PID
+		svc.procStatStartTime = s.StartTime
+	}
+}
+
+// Returns the current state of the services.  c.mu must be held.
+func (c *SvcCollector) currentState() *savedState {
+	state := &savedState{
+		BootTime: c.bootTime,
+		Services: make(map[string]*savedServiceState),
+	}
+	for key, svc := range c.services {
+		state.Services[key] = &savedServiceState{
+			PID: svc.pid,
+			StartTime: svc.procStatStartTime,
+			SeenRunning: svc.seenRunning,
+			Restarts: svc.restarts,
+			ScrapeTimeouts: svc.scrapeTimeouts,
+			UpSeconds: svc.upSeconds,
+			DownSeconds: svc.downSeconds,
+			RestartTimes: svc.restartTimes,
+			ConsecutiveRestarts: svc.consecutiveRestarts,
+		}
+	}
+	return state
+}
+
+// Writes the current state into the state file, if there is one, replacing it
+// atomically.  Unless force is set, the file is only written if anything but
+// the time accounted as up or down has changed since it was last written.
+// c.mu must be held.
+func (c *SvcCollector) saveState(force bool) {
+	if c.stateFile == "" {
+		return
+	}
+	state := c.currentState()
+	if !force && state.sameAs(c.lastSavedState) {
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomically(c.stateFile, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		slog.Error("could not save state", "file", c.stateFile, "err", err)
+		return
+	}
+	c.lastSavedState = state
+}
+
+// Saves the state once the exporter is asked to terminate, and exits.
+func (c *SvcCollector) saveStateOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	slog.Info("saving state and exiting", "signal", sig.String())
+	c.mu.Lock()
+	c.saveState(true)
+	os.Exit(0)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The status of a single service as reported by the /status endpoint.
+type serviceStatus struct {
+	Service string `json:"service"`
+	Instance string `json:"instance,omitempty"`
+	Backend string `json:"backend"`
+	Running bool `json:"running"`
+	// The remaining fields are omitted if unknown or not applicable
+	PID int `json:"pid,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	UptimeSeconds float64 `json:"uptime_seconds,omitempty"`
+	Restarts int64 `json:"restarts"`
+	LastError string `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// e.g. "start/running" for Upstart or "active/running" for systemd
+	InitState string `json:"init_state,omitempty"`
+	ProbeSuccess *bool `json:"probe_success,omitempty"`
+	// "stable", "flapping" or "crashlooping"
+	Stability string `json:"stability"`
+	ConsecutiveRestarts int64 `json:"consecutive_restarts"`
+}
+
+// Scrapes the service identified by key, or all services if key is empty,
+// exactly like a Prometheus scrape would, and returns their status.  Returns
+// false if there is no such service, and errCollectorBusy if ctx expires
+// while waiting for a background check or another scrape to finish.
+func (c *SvcCollector) status(ctx context.Context, key string) ([]*serviceStatus, bool, error) {
+	if !c.lockContext(ctx) {
+		return nil, true, errCollectorBusy
+	}
+	defer c.mu.Unlock()
+
+	services := c.services
+	if key != "" {
+		svc, ok := c.services[key]
+		if !ok {
+			return nil, false, nil
+		}
+		services = map[string]*service{key: svc}
+	}
+	c.scrapeAll(ctx, services)
+	systemUptimeInTicks := c.systemUptimeInTicks()
+	var statuses []*serviceStatus
+	for _, svc := range services {
+		st := &serviceStatus{
+			Service: svc.name,
+			Instance: svc.instance,
+			Backend: svc.config.Backend,
+			Running: svc.pid != -1,
+			Restarts: svc.restarts,
+			LastError: svc.lastError,
+			Stability: svc.stability(time.Now()),
+			ConsecutiveRestarts: svc.consecutiveRestarts,
+		}
+		if st.Running {
+			st.PID = svc.pid
+			startTime := procStatStartTimeToTime(svc.procStatStartTime)
+			st.StartTime = &startTime
+			st.UptimeSeconds = svc.uptimeSeconds(systemUptimeInTicks)
+		}
+		if !svc.lastErrorTime.IsZero() {
+			lastErrorTime := svc.lastErrorTime
+			st.LastErrorTime = &lastErrorTime
+		}
+		if svc.upstartStatus != nil {
+			st.InitState = svc.upstartStatus.goal + "/" + svc.upstartStatus.state
+		} else if svc.unitState != nil {
+			st.InitState = svc.unitState.activeState + "/" + svc.unitState.subState
+		}
+		if svc.probeResult != nil {
+			probeSuccess := svc.probeResult.success
+			st.ProbeSuccess = &probeSuccess
+		}
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Service != statuses[j].Service {
+			return statuses[i].Service < statuses[j].Service
+		}
+		return statuses[i].Instance < statuses[j].Instance
+	})
+	return statuses, true, nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// Serves /status, listing the status of all services, and /status/<service>
+// for a single service.  For instances, <service> is e.g. "worker@1" for
+// systemd or "tty (tty1)" for Upstart.
+func (c *SvcCollector) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/status"), "/")
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+	statuses, ok, err := c.status(ctx, key)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	} else if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown service " + key})
+	} else if key == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"services": statuses})
+	} else {
+		writeJSON(w, http.StatusOK, statuses[0])
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The possible values of a systemd unit's ActiveState, exported as the
+// "state" label of service_unit_state.
+var systemdActiveStates = []string{
+	"active",
+	"activating",
+	"deactivating",
+	"reloading",
+	"inactive",
+	"failed",
+	"maintenance",
+	"refreshing",
+}
+
+type systemdUnitState struct {
+	activeState string
+	subState string
+	result string
+}
+
+// Runs "systemctl show" for a unit and returns the requested properties.
+// Returns errScrapeTimeout if ctx expires first.  If systemctl fails, a
+// discovered service is reported as not running (errServiceNotRunning);
+// for any other service, that and any other failure is fatal.
+func (svc *service) showSystemdUnit(ctx context.Context, unit string, properties ...string) (map[string]string, error) {
+	cmd := backendCommand(ctx, "systemctl", "show", "--property=" + strings.Join(properties, ","), "--", unit)
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	observeBackendCommand(BACKEND_SYSTEMD, "systemctl show", start, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errScrapeTimeout
+		}
+		if svc.config.discovered {
+			slog.Warn("could not query for the status of discovered service", "service", svc.name, "instance", svc.instance, "command", "systemctl show " + unit, "err", err, "output", (strings.SplitN(string(output), "\n", 2))[0])
+			svc.unitState = nil
+			return nil, errServiceNotRunning
+		}
+		fatal("could not query for the status of service", "service", svc.name, "instance", svc.instance, "command", "systemctl show " + unit, "err", err, "output", (strings.SplitN(string(output), "\n", 2))[0])
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		values[parts[0]] = parts[1]
+	}
+	for _, property := range properties {
+		if _, ok := values[property]; !ok {
+			fatal("could not query for the status of service: unexpected output from systemctl show", "service", svc.name, "instance", svc.instance, "unit", unit, "missing_property", property, "output", string(output))
+		}
+	}
+	return values, nil
+}
+
+// Like showSystemdUnit, but for the service's own unit, which must exist
+// unless the service was discovered.  A discovered unit can be unloaded
+// before the next discovery, e.g. a transient unit, and is reported as not
+// running until then (errServiceNotRunning).
+func (svc *service) showServiceUnit(ctx context.Context, properties ...string) (map[string]string, error) {
+	values, err := svc.showSystemdUnit(ctx, svc.config.systemdUnit(), append([]string{"LoadState"}, properties...)...)
+	if err != nil {
+		return nil, err
+	}
+	if values["LoadState"] == "not-found" {
+		if svc.config.discovered {
+			slog.Debug("discovered unit of service not found", "service", svc.name, "instance", svc.instance)
+			svc.unitState = nil
+			svc.gone = true
+			return nil, errServiceNotRunning
+		}
+		fatal("could not query for the status of service: unit not found", "service", svc.name, "instance", svc.instance, "unit", svc.config.systemdUnit())
+	}
+	svc.gone = false
+	return values, nil
+}
+
+// Updates svc.unitState from systemd and returns the unit's main PID.  Returns
+// errServiceNotRunning if the unit is not active or reloading, or has no main
+// process, or errScrapeTimeout.
+func (svc *service) askSystemdForPID(ctx context.Context) (pid int, err error) {
+	values, err := svc.showServiceUnit(ctx, "ActiveState", "SubState", "Result", "MainPID")
+	if err != nil {
+		return 0, err
+	}
+	svc.setSystemdUnitState(values)
+	if svc.unitState.activeState != "active" && svc.unitState.activeState != "reloading" {
+		return 0, errServiceNotRunning
+	}
+	pid, err = strconv.Atoi(values["MainPID"])
+	if err != nil {
+		fatal("could not query for the status of service: unexpected MainPID", "service", svc.name, "instance", svc.instance, "main_pid", values["MainPID"])
+	}
+	if pid == 0 {
+		return 0, errServiceNotRunning
+	}
+	return pid, nil
+}
+
+// Updates svc.unitState without looking at the main PID.
+func (svc *service) refreshSystemdUnitState(ctx context.Context) error {
+	values, err := svc.showServiceUnit(ctx, "ActiveState", "SubState", "Result")
+	if err != nil {
+		return err
+	}
+	svc.setSystemdUnitState(values)
+	return nil
+}
+
+func (svc *service) setSystemdUnitState(values map[string]string) {
+	svc.unitState = &systemdUnitState{
+		activeState: values["ActiveState"],
+		subState: values["SubState"],
+		result: values["Result"],
+	}
+}
+
+// Splits the name of a systemd service unit into the service name and, for
+// instances of template units, the instance, e.g. "worker@1.service" into
+// "worker" and "1".
+func parseSystemdUnitName(unit string) (name string, instance string) {
+	unit = strings.TrimSuffix(unit, ".service")
+	parts := strings.SplitN(unit, "@", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return unit, ""
+}
+
+// The format of timestamps printed by "systemctl show", in the local time
+// zone.
+const SYSTEMD_TIMESTAMP_LAYOUT = "Mon 2006-01-02 15:04:05 MST"
+
+// Parses a timestamp property printed by "systemctl show".  Returns the zero
+// time if the timestamp is not set.
+func parseSystemdTimestamp(value string) (time.Time, error) {
+	if value == "" || value == "n/a" || value == "0" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation(SYSTEMD_TIMESTAMP_LAYOUT, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected timestamp %q", value)
+	}
+	return t, nil
+}
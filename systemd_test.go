@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSystemdTimestamp(t *testing.T) {
+	// systemctl prints timestamps in the local time zone, so parse them as if
+	// it were Europe/Berlin, where the abbreviations are CET and CEST.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %s", err)
+	}
+	local := time.Local
+	time.Local = berlin
+	defer func() { time.Local = local }()
+
+	tests := []struct {
+		value string
+		// The zero time if the timestamp is not set
+		expected time.Time
+		// Whether parsing should fail
+		err bool
+	}{
+		{value: ""},
+		{value: "n/a"},
+		{value: "0"},
+		{
+			value: "Sun 2026-10-18 10:00:42 UTC",
+			expected: time.Date(2026, 10, 18, 10, 0, 42, 0, time.UTC),
+		},
+		{
+			value: "Sun 2026-10-18 12:00:42 CEST",
+			expected: time.Date(2026, 10, 18, 10, 0, 42, 0, time.UTC),
+		},
+		{
+			value: "Mon 2026-01-05 09:30:00 CET",
+			expected: time.Date(2026, 1, 5, 8, 30, 0, 0, time.UTC),
+		},
+		{value: "2026-10-18 10:00:42", err: true},
+		{value: "Sun 2026-10-18", err: true},
+		{value: "yesterday", err: true},
+	}
+	for _, test := range tests {
+		ts, err := parseSystemdTimestamp(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %s, expected an error", test.value, ts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+			continue
+		}
+		if !ts.Equal(test.expected) || ts.IsZero() != test.expected.IsZero() {
+			t.Errorf("%q: got %s, expected %s", test.value, ts, test.expected)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// The name of the file written into the textfile directory.  node_exporter
+// only reads files with the suffix ".prom".
+const TEXTFILE_NAME = "service_exporter.prom"
+
+// Gathers the metrics from the registry and writes them into the node_exporter
+// textfile directory.  The file is replaced atomically, so node_exporter never
+// sees a partially written file.
+func writeTextfile(gatherer prometheus.Gatherer, dir string) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %s", err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		_, err = expfmt.MetricFamilyToText(&buf, mf)
+		if err != nil {
+			return fmt.Errorf("could not encode metrics: %s", err)
+		}
+	}
+
+	return writeFileAtomically(filepath.Join(dir, TEXTFILE_NAME), buf.Bytes(), 0644)
+}
+
+// Writes data into a temporary file next to filename and renames it to
+// filename, so that readers never see a partially written file.
+func writeFileAtomically(filename string, data []byte, perm os.FileMode) error {
+	// The temporary file must not have the suffix of filename, or e.g.
+	// node_exporter might pick it up.  It has to be in the same directory for
+	// the rename to be atomic.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "." + filepath.Base(filename) + ".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// Writes the metrics into the textfile directory every interval, or just once
+// if once is set.  Never returns, except in the latter case.
+func runTextfileMode(gatherer prometheus.Gatherer, dir string, interval time.Duration, once bool) {
+	for {
+		err := writeTextfile(gatherer, dir)
+		if err != nil && once {
+			fatal("could not write metrics", "dir", dir, "err", err)
+		} else if err != nil {
+			slog.Error("could not write metrics", "dir", dir, "err", err)
+		}
+		if once {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The thread name under which threads beyond a service's max_threads limit
+// are aggregated.
+const THREAD_NAME_OTHER = "other"
+
+type threadStats struct {
+	cpuTicks int64
+	voluntaryCtxtSwitches int64
+	nonvoluntaryCtxtSwitches int64
+}
+
+// Splits the contents of a stat file in /proc into fields, such that the
+// PROC_PID_STAT_* constants can be used as indexes.  The second field (comm)
+// is in parentheses and might contain spaces, so everything up to the last
+// closing parenthesis is taken to be part of it.
+func parseProcStat(raw string) ([]string, error) {
+	commStart := strings.IndexByte(raw, '(')
+	commEnd := strings.LastIndexByte(raw, ')')
+	if commStart < 0 || commEnd < commStart {
+		return nil, fmt.Errorf("unexpected stat data")
+	}
+	fields := []string{
+		strings.TrimSpace(raw[:commStart]),
+		raw[commStart+1 : commEnd],
+	}
+	fields = append(fields, strings.Fields(raw[commEnd+1:])...)
+	if len(fields) < 25 {
+		return nil, fmt.Errorf("unexpected stat data")
+	}
+	return fields, nil
+}
+
+// Reads the voluntary and nonvoluntary context switch counts from a status
+// file in /proc.
+func readProcStatusContextSwitches(procStatusPath string) (voluntary int64, nonvoluntary int64, err error) {
+	data, err := ioutil.ReadFile(procStatusPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var dst *int64
+		switch parts[0] {
+		case "voluntary_ctxt_switches":
+			dst = &voluntary
+		case "nonvoluntary_ctxt_switches":
+			dst = &nonvoluntary
+		default:
+			continue
+		}
+		*dst, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("garbage data in %s: %s", procStatusPath, err)
+		}
+	}
+	return voluntary, nonvoluntary, nil
+}
+
+// Reads the name, CPU time and context switches of a single thread.  Returns
+// an error satisfying os.IsNotExist() if the thread has exited.
+func readThreadStats(taskPath string) (name string, stats threadStats, err error) {
+	comm, err := ioutil.ReadFile(path.Join(taskPath, "comm"))
+	if err != nil {
+		return "", stats, err
+	}
+	name = strings.TrimRight(string(comm), "\n")
+
+	rawStat, err := ioutil.ReadFile(path.Join(taskPath, "stat"))
+	if err != nil {
+		return "", stats, err
+	}
+	statData, err := parseProcStat(string(rawStat))
+	if err != nil {
+		return "", stats, fmt.Errorf("%s: %s", taskPath, err)
+	}
+	for _, idx := range []int{PROC_PID_STAT_UTIME, PROC_PID_STAT_STIME} {
+		val, err := strconv.ParseInt(statData[idx], 10, 64)
+		if err != nil {
+			return "", stats, fmt.Errorf("garbage data at column index %d in %s/stat", idx + 1, taskPath)
+		}
+		stats.cpuTicks += val
+	}
+
+	stats.voluntaryCtxtSwitches, stats.nonvoluntaryCtxtSwitches, err =
+		readProcStatusContextSwitches(path.Join(taskPath, "status"))
+	if err != nil {
+		return "", stats, err
+	}
+	return name, stats, nil
+}
+
+// Reads the per-thread statistics of the service's process and aggregates
+// them by normalized thread name.  Since threads which have exited are no
+// longer accounted for, the aggregated values can go backwards.
+func (svc *service) scrapeThreads() {
+	tc := svc.config.Threads
+	svc.threadStats = make(map[string]*threadStats)
+
+	taskDir := path.Join("/proc", strconv.Itoa(svc.pid), "task")
+	tasks, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("could not list threads of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "err", err)
+		}
+		return
+	}
+	for _, task := range tasks {
+		name, stats, err := readThreadStats(path.Join(taskDir, task.Name()))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("could not read thread of service", "service", svc.name, "instance", svc.instance, "pid", svc.pid, "thread", task.Name(), "err", err)
+			}
+			continue
+		}
+		name = tc.normalizeRegexp.ReplaceAllString(name, tc.NormalizeReplacement)
+		agg, ok := svc.threadStats[name]
+		if !ok {
+			if len(svc.threadStats) >= tc.MaxThreads {
+				name = THREAD_NAME_OTHER
+				agg = svc.threadStats[name]
+			}
+			if agg == nil {
+				agg = &threadStats{}
+				svc.threadStats[name] = agg
+			}
+		}
+		agg.cpuTicks += stats.cpuTicks
+		agg.voluntaryCtxtSwitches += stats.voluntaryCtxtSwitches
+		agg.nonvoluntaryCtxtSwitches += stats.nonvoluntaryCtxtSwitches
+	}
+}
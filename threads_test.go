@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	// The fields after comm, as in /proc/<pid>/stat: utime 11, stime 12,
+	// cutime 13, cstime 14, starttime 410531, vsize 2703360, rss 313
+	const rest = "R 30600 30604 30600 0 -1 4194304 80 0 0 0 11 12 13 14 20 0 1 0 410531 2703360 313 18446744073709551615 94179407482880 0"
+	tests := []struct {
+		name string
+		raw string
+		comm string
+		// Empty if parsing should succeed
+		err string
+	}{
+		{
+			name: "plain",
+			raw: "30604 (cat) " + rest + "\n",
+			comm: "cat",
+		},
+		{
+			name: "spaces in comm",
+			raw: "30604 (a b) " + rest + "\n",
+			comm: "a b",
+		},
+		{
+			name: "closing parenthesis in comm",
+			raw: "30604 (x) y) " + rest + "\n",
+			comm: "x) y",
+		},
+		{
+			name: "empty comm",
+			raw: "30604 () " + rest + "\n",
+			comm: "",
+		},
+		{
+			name: "truncated after comm",
+			raw: "30604 (cat) R 30600 30604 30600 0 -1 4194304 80 0 0 0 11 12",
+			err: "unexpected stat data",
+		},
+		{
+			name: "truncated within comm",
+			raw: "30604 (ca",
+			err: "unexpected stat data",
+		},
+		{
+			name: "empty",
+			raw: "",
+			err: "unexpected stat data",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, err := parseProcStat(test.raw)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fields[0] != "30604" || fields[1] != test.comm || fields[2] != "R" {
+				t.Errorf("got pid %q, comm %q, state %q", fields[0], fields[1], fields[2])
+			}
+			for idx, expected := range map[int]string{
+				PROC_PID_STAT_UTIME: "11",
+				PROC_PID_STAT_STIME: "12",
+				PROC_PID_STAT_CUTIME: "13",
+				PROC_PID_STAT_CSTIME: "14",
+				PROC_PID_STAT_STARTTIME: "410531",
+				PROC_PID_STAT_VSIZE: "2703360",
+				PROC_PID_STAT_RSS: "313",
+			} {
+				if fields[idx] != expected {
+					t.Errorf("got %q at index %d, expected %q", fields[idx], idx, expected)
+				}
+			}
+		})
+	}
+}
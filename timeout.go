@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// How much of the scrape timeout sent by Prometheus is left for encoding and
+// sending the response.
+const SCRAPE_TIMEOUT_OFFSET = 500 * time.Millisecond
+
+// How long discovering the services from the init system may take.
+const DISCOVERY_TIMEOUT = time.Minute
+
+// The maximum number of services scraped at the same time.
+const MAX_CONCURRENT_SCRAPES = 8
+
+// Returns a context which expires shortly before Prometheus gives up on the
+// request according to the X-Prometheus-Scrape-Timeout-Seconds header, or
+// when the client goes away.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeoutSeconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || timeoutSeconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(timeoutSeconds * float64(time.Second))
+	if timeout > SCRAPE_TIMEOUT_OFFSET {
+		timeout -= SCRAPE_TIMEOUT_OFFSET
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// Acquires c.mu, unless ctx expires first, e.g. while a background check of a
+// hung init system holds it.  Returns whether c.mu was acquired.
+func (c *SvcCollector) lockContext(ctx context.Context) bool {
+	if c.mu.TryLock() {
+		return true
+	}
+	locked := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-ctx.Done():
+		// Release c.mu once it's finally acquired.
+		go func() {
+			<-locked
+			c.mu.Unlock()
+		}()
+		return false
+	}
+}
+
+// Collects the metrics of the services for a single request, with the
+// request's context.
+type requestCollector struct {
+	ctx context.Context
+	collector *SvcCollector
+}
+
+func (rc *requestCollector) Describe(ch chan<- *prometheus.Desc) {
+	rc.collector.Describe(ch)
+}
+
+func (rc *requestCollector) Collect(ch chan<- prometheus.Metric) {
+	rc.collector.collect(rc.ctx, ch)
+}
+
+// Returns the handler for /metrics, which serves the metrics of the services,
+// scraped within the scrape timeout, along with the ones gathered from
+// gatherer.
+func (c *SvcCollector) metricsHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		registry := prometheus.NewPedanticRegistry()
+		err := registry.Register(&requestCollector{
+			ctx: ctx,
+			collector: c,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promhttp.HandlerFor(prometheus.Gatherers{gatherer, registry}, promhttp.HandlerOpts{
+			ErrorLog: elog,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// Returns a command querying the init system, which is killed if ctx expires.
+func backendCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Don't wait for any children still holding on to the output pipe once
+	// the command has been killed, e.g. initctl run by the service script;
+	// the deadline is usually Prometheus's.
+	cmd.WaitDelay = 100 * time.Millisecond
+	return cmd
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The possible goals and states of an Upstart job, exported as the "goal"
+// label of service_upstart_goal and the "state" label of
+// service_upstart_state.
+var upstartGoals = []string{
+	"start",
+	"stop",
+}
+
+var upstartStates = []string{
+	"waiting",
+	"starting",
+	"pre-start",
+	"spawned",
+	"post-start",
+	"running",
+	"pre-stop",
+	"stopping",
+	"killed",
+	"post-stop",
+}
+
+type upstartStatus struct {
+	goal string
+	state string
+
+	// -1 if no process was listed
+	pid int
+}
+
+// Parses a status line as printed by "status" or "initctl list", e.g.
+// "tty (tty1) start/running, process 1234".  Any lines after the first one
+// (listing the processes of the job's pre-start and post-start scripts etc.)
+// are ignored.
+func parseUpstartStatus(output string) (*upstartStatus, error) {
+	line := (strings.SplitN(output, "\n", 2))[0]
+	commaSeparated := strings.Split(line, ",")
+	if len(commaSeparated) > 2 {
+		return nil, fmt.Errorf("unexpected service status %s", line)
+	}
+	parts := strings.Split(commaSeparated[0], " ")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("unexpected service status %s", line)
+	}
+	goalState := strings.Split(parts[len(parts) - 1], "/")
+	if len(goalState) != 2 {
+		return nil, fmt.Errorf("unexpected service status %s", line)
+	}
+	status := &upstartStatus{
+		goal: goalState[0],
+		state: goalState[1],
+		pid: -1,
+	}
+	if len(commaSeparated) == 2 {
+		parts = strings.Split(commaSeparated[1], " ")
+		pidStr := strings.TrimSpace(parts[len(parts) - 1])
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected PID %s", pidStr)
+		}
+		status.pid = pid
+	}
+	return status, nil
+}
+
+// Runs the given command, which is expected to list the status of the
+// service.  Returns errScrapeTimeout if ctx expires first.  Any other failure
+// is fatal, unless the service was discovered: Upstart forgets about a job
+// once its configuration is removed, so a discovered job which fails to
+// answer is reported as not running (errServiceNotRunning) until the next
+// discovery.
+func (svc *service) runUpstartStatusCommand(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := backendCommand(ctx, name, args...)
+	cmdStr := strings.Join(append([]string{name}, args...), " ")
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	// The subcommand comes last, e.g. "service foo status" or "initctl list"
+	observeBackendCommand(BACKEND_UPSTART, name + " " + args[len(args) - 1], start, err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", errScrapeTimeout
+		}
+		if svc.config.discovered {
+			slog.Debug("could not query for the status of discovered service", "service", svc.name, "instance", svc.instance, "command", cmdStr, "err", err, "output", strings.TrimSpace(string(output)))
+			svc.upstartStatus = nil
+			svc.gone = true
+			return "", errServiceNotRunning
+		}
+		fatal("could not query for the status of service", "service", svc.name, "instance", svc.instance, "command", cmdStr, "err", err, "output", (strings.SplitN(string(output), "\n", 2))[0])
+	}
+	svc.gone = false
+	return string(output), nil
+}
+
+// Finds the status line of the service's instance in the output of
+// "initctl list".  Instances which are not running are not listed, so if
+// none is found, the instance is reported as stop/waiting.
+func (svc *service) askUpstartForInstanceStatus(ctx context.Context) (string, error) {
+	output, err := svc.runUpstartStatusCommand(ctx, "initctl", "list")
+	if err != nil {
+		return "", err
+	}
+	prefix := svc.name + " (" + svc.instance + ") "
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line, nil
+		}
+	}
+	return prefix + "stop/waiting", nil
+}
+
+// Updates svc.upstartStatus from Upstart and returns the job's main PID.
+// Returns errServiceNotRunning unless the job is in start/running, or
+// errScrapeTimeout.
+func (svc *service) askUpstartForPID(ctx context.Context) (pid int, err error) {
+	var output string
+	if svc.instance == "" {
+		output, err = svc.runUpstartStatusCommand(ctx, "service", svc.name, "status")
+	} else {
+		output, err = svc.askUpstartForInstanceStatus(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	status, err := parseUpstartStatus(output)
+	if err != nil {
+		fatal("could not query for the status of service: could not parse status", "service", svc.name, "instance", svc.instance, "err", err, "output", output)
+	}
+	svc.upstartStatus = status
+	if status.goal != "start" || status.state != "running" {
+		return 0, errServiceNotRunning
+	}
+	if status.pid == -1 {
+		fatal("could not query for the status of service: no PID in status", "service", svc.name, "instance", svc.instance, "output", output)
+	}
+	return status.pid, nil
+}
+
+// Updates svc.upstartStatus without looking at the main PID.
+func (svc *service) refreshUpstartStatus(ctx context.Context) error {
+	_, err := svc.askUpstartForPID(ctx)
+	if err == errScrapeTimeout {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUpstartStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		output string
+		// nil if parsing should fail
+		status *upstartStatus
+	}{
+		{
+			name: "running",
+			output: "cron start/running, process 1234\n",
+			status: &upstartStatus{goal: "start", state: "running", pid: 1234},
+		},
+		{
+			name: "stopped",
+			output: "cron stop/waiting\n",
+			status: &upstartStatus{goal: "stop", state: "waiting", pid: -1},
+		},
+		{
+			name: "instance",
+			output: "tty (tty1) start/running, process 987\n",
+			status: &upstartStatus{goal: "start", state: "running", pid: 987},
+		},
+		{
+			name: "instance stopping",
+			output: "tty (tty2) stop/stopping\n",
+			status: &upstartStatus{goal: "stop", state: "stopping", pid: -1},
+		},
+		{
+			name: "pre-start",
+			output: "mysql start/pre-start, process 4321\n\tpre-start process 4321\n",
+			status: &upstartStatus{goal: "start", state: "pre-start", pid: 4321},
+		},
+		{
+			name: "post-start",
+			output: "mysql start/post-start, process 4400\n\tpost-start process 4410\n",
+			status: &upstartStatus{goal: "start", state: "post-start", pid: 4400},
+		},
+		{
+			name: "running with post-start script",
+			output: "mysql start/running, process 4400\n\tpost-start process 4410\n",
+			status: &upstartStatus{goal: "start", state: "running", pid: 4400},
+		},
+		{
+			name: "unknown job",
+			output: "status: Unknown job: cron\n",
+		},
+		{
+			name: "no job name",
+			output: "start/running, process 1234\n",
+		},
+		{
+			name: "garbage PID",
+			output: "cron start/running, process abc\n",
+		},
+		{
+			name: "too many commas",
+			output: "cron start/running, process 1, process 2\n",
+		},
+		{
+			name: "empty",
+			output: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, err := parseUpstartStatus(test.output)
+			if test.status == nil {
+				if err == nil {
+					t.Fatalf("got %+v, expected an error", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(status, test.status) {
+				t.Errorf("got %+v, expected %+v", status, test.status)
+			}
+		})
+	}
+}
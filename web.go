@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// The contents of the file given with --web.config.file, in the format used
+// by the Prometheus exporter-toolkit.
+type webConfig struct {
+	TLSServerConfig *webTLSConfig `yaml:"tls_server_config"`
+	HTTPServerConfig webHTTPConfig `yaml:"http_server_config"`
+	// Maps user names to bcrypt hashed passwords
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+
+	tlsReloader *tlsReloader
+	authCache *basicAuthCache
+}
+
+type webTLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile string `yaml:"key_file"`
+	ClientAuthType string `yaml:"client_auth_type"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	MinVersion string `yaml:"min_version"`
+	MaxVersion string `yaml:"max_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	PreferServerCipherSuites bool `yaml:"prefer_server_cipher_suites"`
+}
+
+type webHTTPConfig struct {
+	// Defaults to true
+	HTTP2 *bool `yaml:"http2"`
+	// Added to every response
+	Headers map[string]string `yaml:"headers"`
+}
+
+// The protocols offered through ALPN.
+func (hc *webHTTPConfig) nextProtos() []string {
+	if hc.HTTP2 != nil && !*hc.HTTP2 {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert": tls.NoClientCert,
+	"RequestClientCert": tls.RequestClientCert,
+	"RequireAnyClientCert": tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven": tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+func readWebConfigFile(filename string) (*webConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	wc := &webConfig{}
+	err = yaml.Unmarshal(data, wc)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", filename, err)
+	}
+	for user, hash := range wc.BasicAuthUsers {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("invalid password hash for user %s: %s", user, err)
+		}
+	}
+	wc.authCache = newBasicAuthCache()
+	if wc.TLSServerConfig != nil {
+		wc.tlsReloader, err = newTLSReloader(wc.TLSServerConfig, wc.HTTPServerConfig.nextProtos())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wc, nil
+}
+
+// Builds the parts of the TLS configuration which don't depend on the
+// contents of the certificate files.
+func (tc *webTLSConfig) baseTLSConfig() (*tls.Config, error) {
+	if tc.CertFile == "" || tc.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file are required in tls_server_config")
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		PreferServerCipherSuites: tc.PreferServerCipherSuites,
+	}
+	if tc.MinVersion != "" {
+		version, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", tc.MinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if tc.MaxVersion != "" {
+		version, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown max_version %q", tc.MaxVersion)
+		}
+		cfg.MaxVersion = version
+	}
+	for _, name := range tc.CipherSuites {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	cfg.ClientAuth = tls.NoClientCert
+	if tc.ClientAuthType != "" {
+		authType, ok := tlsClientAuthTypes[tc.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", tc.ClientAuthType)
+		}
+		cfg.ClientAuth = authType
+	}
+	if tc.ClientCAFile != "" && cfg.ClientAuth == tls.NoClientCert {
+		return nil, fmt.Errorf("client_ca_file is set, but client_auth_type is NoClientCert")
+	}
+	if tc.ClientCAFile == "" && (cfg.ClientAuth == tls.VerifyClientCertIfGiven || cfg.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", tc.ClientAuthType)
+	}
+	return cfg, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Serves the TLS configuration, re-reading the certificate, key and client CA
+// files whenever any of them changes.
+type tlsReloader struct {
+	tc *webTLSConfig
+	base *tls.Config
+
+	mu sync.Mutex
+	modTimes []time.Time
+	current *tls.Config
+}
+
+func newTLSReloader(tc *webTLSConfig, nextProtos []string) (*tlsReloader, error) {
+	base, err := tc.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	base.NextProtos = nextProtos
+	r := &tlsReloader{tc: tc, base: base}
+	_, err = r.config()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.tc.CertFile, r.tc.KeyFile}
+	if r.tc.ClientCAFile != "" {
+		files = append(files, r.tc.ClientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.tc.CertFile, r.tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %s", err)
+	}
+	cfg := r.base.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	if r.tc.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.tc.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read client CA file: %s", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", r.tc.ClientCAFile)
+		}
+	}
+	return cfg, nil
+}
+
+// Returns the current TLS configuration, reloading the files if they have
+// changed.  If reloading fails, the previous configuration is kept.
+func (r *tlsReloader) config() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var modTimes []time.Time
+	changed := r.current == nil
+	for i, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			modTimes = nil
+			changed = r.current == nil
+			break
+		}
+		modTimes = append(modTimes, fi.ModTime())
+		if r.modTimes == nil || !r.modTimes[i].Equal(fi.ModTime()) {
+			changed = true
+		}
+	}
+	if !changed {
+		return r.current, nil
+	}
+	cfg, err := r.load()
+	if err != nil && r.current != nil {
+		slog.Error("could not reload TLS configuration, keeping the previous one", "err", err)
+		r.modTimes = modTimes
+		return r.current, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if r.current != nil {
+		slog.Info("reloaded TLS certificates")
+	}
+	r.current = cfg
+	r.modTimes = modTimes
+	return r.current, nil
+}
+
+// The configurations returned by GetConfigForClient replace this one for the
+// handshake, so they carry NextProtos themselves.
+func (r *tlsReloader) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: r.base.NextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config()
+		},
+	}
+}
+
+// Remembers the outcome of recent password checks, since bcrypt is
+// deliberately slow.
+type basicAuthCache struct {
+	mu sync.Mutex
+	results map[[sha256.Size]byte]bool
+}
+
+// The maximum number of entries in basicAuthCache before it's cleared.
+const BASIC_AUTH_CACHE_SIZE = 100
+
+func newBasicAuthCache() *basicAuthCache {
+	return &basicAuthCache{results: make(map[[sha256.Size]byte]bool)}
+}
+
+func (c *basicAuthCache) check(user string, password string, hash string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	c.mu.Lock()
+	result, ok := c.results[key]
+	c.mu.Unlock()
+	if ok {
+		return result
+	}
+	result = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	c.mu.Lock()
+	if len(c.results) >= BASIC_AUTH_CACHE_SIZE {
+		c.results = make(map[[sha256.Size]byte]bool)
+	}
+	c.results[key] = result
+	c.mu.Unlock()
+	return result
+}
+
+// A bcrypt hash which no password matches, compared against for unknown users
+// so that they take as long to reject as known ones.
+const BASIC_AUTH_DUMMY_HASH = "$2a$10$FAKRd7Q1nH8JfwOjHeNyAeYAt6zSUgnrggaVCPwn9efpkwCfkwW2a"
+
+// Wraps the handler to add the configured headers and to require basic
+// authentication if any users are configured.
+func (wc *webConfig) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range wc.HTTPServerConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		if len(wc.BasicAuthUsers) > 0 {
+			user, password, ok := r.BasicAuth()
+			authorized := false
+			if ok {
+				hash, known := wc.BasicAuthUsers[user]
+				if !known {
+					hash = BASIC_AUTH_DUMMY_HASH
+				}
+				authorized = wc.authCache.check(user, password, hash) && known
+			}
+			if !authorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="service exporter"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Serves handler on all the listeners, with TLS and authentication as
+// configured in wc, which may be nil.  Only returns on error.
+func serveHTTP(listeners []net.Listener, wc *webConfig, handler http.Handler) error {
+	server := &http.Server{
+		Handler: handler,
+	}
+	if wc != nil {
+		server.Handler = wc.wrap(handler)
+		if wc.HTTPServerConfig.HTTP2 != nil && !*wc.HTTPServerConfig.HTTP2 {
+			server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+		if wc.tlsReloader != nil {
+			server.TLSConfig = wc.tlsReloader.serverTLSConfig()
+		}
+	}
+
+	// Decided up front, since Serve sets up server.TLSConfig for HTTP/2
+	useTLS := server.TLSConfig != nil
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		slog.Info("listening", "address", l.Addr().String())
+		go func(l net.Listener) {
+			if useTLS {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}(l)
+	}
+	return <-errs
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Writes a self-signed certificate for 127.0.0.1 with the given common name,
+// and its key, to the given files, dated modTime.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		err = ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The reloader goes by the modification times, which could otherwise
+		// be the same for two certificates written in quick succession
+		err = os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Serves a handler answering "ok" as configured in the given web config file,
+// and returns its address.
+func startTestWebServer(t *testing.T, webConfigYAML string) string {
+	t.Helper()
+	filename := writeFixture(t, "web.yml", webConfigYAML)
+	wc, err := readWebConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveHTTP([]net.Listener{l}, wc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	return l.Addr().String()
+}
+
+func TestWebBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestWebServer(t, "basic_auth_users:\n  prometheus: " + string(hash) + "\n")
+
+	tests := []struct {
+		name string
+		// Empty to send no credentials
+		user string
+		password string
+		status int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong password", "prometheus", "guess", http.StatusUnauthorized},
+		{"unknown user", "admin", "secret", http.StatusUnauthorized},
+		{"correct password", "prometheus", "secret", http.StatusOK},
+		// Answered from the cache this time
+		{"correct password again", "prometheus", "secret", http.StatusOK},
+		{"wrong password again", "prometheus", "guess", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://" + addr + "/metrics", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d, expected %d", resp.StatusCode, test.status)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("got no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+// Returns the common name of the certificate the server presents, and the
+// protocol negotiated through ALPN when offering h2 and http/1.1.
+func dialTestTLS(t *testing.T, addr string) (string, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	return state.PeerCertificates[0].Subject.CommonName, state.NegotiatedProtocol
+}
+
+func TestWebTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	t0 := time.Now().Add(-time.Minute)
+	writeTestCert(t, certFile, keyFile, "first", t0)
+	addr := startTestWebServer(t, "tls_server_config:\n" +
+		"  cert_file: " + certFile + "\n" +
+		"  key_file: " + keyFile + "\n")
+
+	if cn, _ := dialTestTLS(t, addr); cn != "first" {
+		t.Fatalf("got certificate %q, expected \"first\"", cn)
+	}
+	writeTestCert(t, certFile, keyFile, "second", t0.Add(time.Second))
+	if cn, _ := dialTestTLS(t, addr); cn != "second" {
+		t.Errorf("got certificate %q after swapping it, expected \"second\"", cn)
+	}
+
+	// A broken certificate is ignored
+	err := ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn, _ := dialTestTLS(t, addr); cn != "second" {
+		t.Errorf("got certificate %q after breaking it, expected \"second\"", cn)
+	}
+}
+
+func TestWebHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, "test", time.Now())
+	tlsConfig := "tls_server_config:\n" +
+		"  cert_file: " + certFile + "\n" +
+		"  key_file: " + keyFile + "\n"
+
+	tests := []struct {
+		name string
+		httpServerConfig string
+		proto string
+	}{
+		{"default", "", "h2"},
+		{"enabled", "http_server_config:\n  http2: true\n", "h2"},
+		{"disabled", "http_server_config:\n  http2: false\n", "http/1.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestWebServer(t, tlsConfig + test.httpServerConfig)
+			if _, proto := dialTestTLS(t, addr); proto != test.proto {
+				t.Errorf("got protocol %q, expected %q", proto, test.proto)
+			}
+
+			// Actually served over the protocol
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+			resp, err := client.Get("https://" + addr + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			expected := "HTTP/1.1"
+			if test.proto == "h2" {
+				expected = "HTTP/2.0"
+			}
+			if resp.Proto != expected {
+				t.Errorf("got %s, expected %s", resp.Proto, expected)
+			}
+		})
+	}
+}